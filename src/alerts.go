@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+)
+
+// Alert is a problem, or the end of one, worth telling someone about.
+type Alert struct {
+	Time time.Time `json:"time"`
+	// Source is the check that raised the alert and Subject what it is about, i.e. anomaly and
+	// active streams.
+	Source   string `json:"source"`
+	Subject  string `json:"subject"`
+	Message  string `json:"message"`
+	Resolved bool   `json:"resolved"`
+	// Streams are the source streams the alert is about, if any.
+	Streams []string `json:"streams,omitempty"`
+	// Hosts are the hosts the alert is about, if any.
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+func (a *Alert) String() string {
+	state := "ALERT"
+	if a.Resolved {
+		state = "RESOLVED"
+	}
+	return fmt.Sprintf("[%s] %s %s: %s", state, a.Source, a.Subject, a.Message)
+}
+
+// notifier delivers alerts somewhere people will see them.
+type notifier interface {
+	notify(ctx context.Context, a *Alert) error
+}
+
+// logNotifier writes alerts to the log.
+type logNotifier struct{}
+
+func (logNotifier) notify(_ context.Context, a *Alert) error {
+	log.Warning("%s", a)
+	return nil
+}
+
+// webhookNotifier posts alerts as json. The text field makes the body usable as a Slack incoming
+// webhook message; the alert field carries the details for anything else.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) notify(ctx context.Context, a *Alert) error {
+	body, err := json.Marshal(struct {
+		Text  string `json:"text"`
+		Alert *Alert `json:"alert"`
+	}{a.String(), a})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s returned %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+// alerter sends alerts to every notifier. A failing notifier does not stop the others. When offline is
+// set, alerts about streams that are all expected to be off the air are dropped, and when maintenance
+// is set so are alerts about a host in maintenance.
+type alerter struct {
+	notifiers   []notifier
+	offline     func(ctx context.Context, now time.Time) map[string]*Offline
+	maintenance func(ctx context.Context, now time.Time) maintenanceSet
+}
+
+func newAlerter(webhooks []string) *alerter {
+	a := &alerter{notifiers: []notifier{logNotifier{}}}
+	for _, url := range webhooks {
+		a.notifiers = append(a.notifiers, &webhookNotifier{url: url, client: &http.Client{Timeout: 5 * time.Second}})
+	}
+	return a
+}
+
+func (a *alerter) send(ctx context.Context, alert *Alert) {
+	if a == nil || a.suppressed(ctx, alert) {
+		return
+	}
+	for _, n := range a.notifiers {
+		if err := n.notify(ctx, alert); err != nil {
+			log.Error("could not send alert %s: %s", alert, err)
+		}
+	}
+}
+
+func (a *alerter) suppressed(ctx context.Context, alert *Alert) bool {
+	if a.maintenance != nil && len(alert.Hosts) > 0 {
+		if m := a.maintenance(ctx, alert.Time).find(alert.Hosts...); m != nil {
+			log.Info("suppressed while %s %s: %s", m.Host, m, alert)
+			return true
+		}
+	}
+	if a.offline == nil || len(alert.Streams) == 0 {
+		return false
+	}
+	offline := a.offline(ctx, alert.Time)
+	for _, id := range alert.Streams {
+		if offline[id] == nil {
+			return false
+		}
+	}
+	log.Info("suppressed while expected offline: %s", alert)
+	return true
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/garyburd/redigo/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Annotation is an operator's note on a catcher ip, redirect host or source stream id.
+type Annotation struct {
+	ID     string    `json:"id"`
+	Target string    `json:"target"`
+	Text   string    `json:"text"`
+	Author string    `json:"author,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+func (a *Annotation) String() string {
+	s := a.Time.Format("Jan 2 15:04")
+	if a.Author != "" {
+		s += " " + a.Author
+	}
+	return s + ": " + a.Text
+}
+
+// about reports whether the note is on any of names. Host names also match by short name.
+func (a *Annotation) about(names ...string) bool {
+	for _, n := range names {
+		if n == "" {
+			continue
+		}
+		if n == a.Target || (net.ParseIP(n) == nil && shortHost(n) == shortHost(a.Target)) {
+			return true
+		}
+	}
+	return false
+}
+
+// annotations is a set of notes, newest first.
+type annotations []*Annotation
+
+// on returns the notes on any of names, newest first.
+func (as annotations) on(names ...string) annotations {
+	var out annotations
+	for _, a := range as {
+		if a.about(names...) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// keepAnnotations is how many notes a store keeps. Adding more drops the oldest.
+const keepAnnotations = 1000
+
+// annotationStore keeps the newest keepAnnotations notes. Notes are only ever added.
+type annotationStore interface {
+	Annotations(ctx context.Context) (annotations, error)
+	Add(ctx context.Context, a *Annotation) error
+}
+
+func sortAnnotations(as annotations) {
+	sort.SliceStable(as, func(i, j int) bool {
+		return as[i].Time.After(as[j].Time)
+	})
+}
+
+// memAnnotations keeps notes in memory. It serves demo mode, where there is no redis to share.
+type memAnnotations struct {
+	mu    sync.Mutex
+	notes annotations
+}
+
+func (m *memAnnotations) Annotations(_ context.Context) (annotations, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	as := append(annotations{}, m.notes...)
+	sortAnnotations(as)
+	return as, nil
+}
+
+func (m *memAnnotations) Add(_ context.Context, a *Annotation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notes = append(m.notes, a)
+	if len(m.notes) > keepAnnotations {
+		m.notes = m.notes[len(m.notes)-keepAnnotations:]
+	}
+	return nil
+}
+
+// redisAnnotations keeps notes as json in a redis list so every instance and shift sees them.
+type redisAnnotations struct {
+	redisServer
+	key string
+}
+
+func newRedisAnnotations(rs redisServer, key string) *redisAnnotations {
+	return &redisAnnotations{redisServer: rs, key: key}
+}
+
+func (db *redisAnnotations) Annotations(ctx context.Context) (annotations, error) {
+	vals, err := redis.Strings(db.do(ctx, "LRANGE", db.key, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	as := annotations{}
+	for _, val := range vals {
+		a := &Annotation{}
+		if err := json.Unmarshal([]byte(val), a); err != nil {
+			log.Error("skipping bad annotation %q in %s: %s", val, db.key, err)
+			continue
+		}
+		as = append(as, a)
+	}
+	sortAnnotations(as)
+	return as, nil
+}
+
+func (db *redisAnnotations) Add(ctx context.Context, a *Annotation) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if _, err = db.do(ctx, "RPUSH", db.key, b); err != nil {
+		return err
+	}
+	_, err = db.do(ctx, "LTRIM", db.key, -keepAnnotations, -1)
+	return err
+}
+
+// annotations returns every note. Without a store, or if it cannot be read, there are none.
+func (s *server) annotations(ctx context.Context) annotations {
+	if s.notes == nil {
+		return nil
+	}
+	as, err := s.notes.Annotations(ctx)
+	if err != nil {
+		log.Error("could not read annotations %s", err)
+		return nil
+	}
+	return as
+}
+
+// AnnotationsJSON lists the notes, newest first, only those on the target query parameter when given.
+func (s *server) AnnotationsJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.notes == nil {
+		http.Error(w, "no annotation store configured", http.StatusNotFound)
+		return
+	}
+	as, err := s.notes.Annotations(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if target := r.URL.Query().Get("target"); target != "" {
+		as = as.on(target)
+	}
+	if as == nil {
+		as = annotations{}
+	}
+	serveJson(w, as)
+}
+
+// AddAnnotation adds a note from a json body holding its target, text and author. The time and id are
+// set here.
+func (s *server) AddAnnotation(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.notes == nil {
+		http.Error(w, "no annotation store configured", http.StatusNotFound)
+		return
+	}
+	a := &Annotation{}
+	if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+		http.Error(w, "could not read annotation: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.Target, a.Text = strings.TrimSpace(a.Target), strings.TrimSpace(a.Text)
+	if a.Target == "" || a.Text == "" {
+		http.Error(w, "target and text are required", http.StatusBadRequest)
+		return
+	}
+	a.Time = time.Now()
+	a.ID = fmt.Sprintf("%d", a.Time.UnixNano())
+	if err := s.notes.Add(r.Context(), a); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveJson(w, a)
+}
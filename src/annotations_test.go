@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotationsOn(t *testing.T) {
+	now := time.Now()
+	as := annotations{
+		{Target: "KAAA-1001", Text: "encoder replaced", Time: now},
+		{Target: "redirect01", Text: "slow disk", Time: now.Add(-time.Minute)},
+		{Target: "10.10.1.1", Text: "flaky nic", Time: now.Add(-time.Hour)},
+	}
+	assert.Equal(t, as[:1], as.on("KAAA-1001"))
+	assert.Equal(t, as[1:2], as.on("redirect01.syncbak.corp"))
+	assert.Equal(t, as[2:], as.on("", "10.10.1.1"))
+	assert.Empty(t, as.on("10.10.1.11", "KAAA-1002"))
+}
+
+func TestAnnotationsCapped(t *testing.T) {
+	m := &memAnnotations{}
+	now := time.Now()
+	for i := 0; i < keepAnnotations+2; i++ {
+		assert.Nil(t, m.Add(context.Background(), &Annotation{ID: fmt.Sprint(i), Time: now.Add(time.Duration(i) * time.Second)}))
+	}
+	as, err := m.Annotations(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, as, keepAnnotations)
+	assert.Equal(t, fmt.Sprint(keepAnnotations+1), as[0].ID)
+	assert.Equal(t, "2", as[len(as)-1].ID, "the oldest are dropped")
+}
+
+func TestAnnotationsAPI(t *testing.T) {
+	s := testServer(t)
+	s.notes = &memAnnotations{}
+
+	for _, body := range []string{
+		`{"target": "KAAA-1001", "text": "encoder replaced at station, watch for drops", "author": "mkim"}`,
+		`{"target": "10.10.1.12", "text": "fan alarm"}`,
+		`{"target": "redirect01.syncbak.corp", "text": "draining for upgrade"}`,
+	} {
+		w := send(s, "POST", "/api/annotations", body)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	assert.Equal(t, http.StatusBadRequest, send(s, "POST", "/api/annotations", `{"target": "KAAA-1001"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send(s, "POST", "/api/annotations", `{`).Code)
+
+	var as annotations
+	assert.Nil(t, json.Unmarshal(get(s, "/api/annotations").Body.Bytes(), &as))
+	assert.Len(t, as, 3)
+	assert.Equal(t, "redirect01.syncbak.corp", as[0].Target, "newest first")
+	as = nil
+	assert.Nil(t, json.Unmarshal(get(s, "/api/annotations?target=KAAA-1001").Body.Bytes(), &as))
+	if assert.Len(t, as, 1) {
+		assert.Equal(t, "mkim", as[0].Author)
+		assert.False(t, as[0].Time.IsZero())
+	}
+	assert.Equal(t, "[]", get(s, "/api/annotations?target=KZZZ-1").Body.String())
+
+	body := get(s, "/").Body.String()
+	assert.Contains(t, body, "mkim: encoder replaced at station, watch for drops")
+	assert.Contains(t, body, ": fan alarm")
+	assert.Contains(t, body, ": draining for upgrade")
+	assert.Contains(t, get(s, "/adapters").Body.String(), "watch for drops")
+
+	assert.Equal(t, http.StatusNotFound, get(testServer(t), "/api/annotations").Code)
+}
+
+func TestAnnotationsOnEvents(t *testing.T) {
+	l, cleanup := tempEventLog(t)
+	defer cleanup()
+	s := testServer(t)
+	s.tracker = newTracker(l, nil)
+	s.notes = &memAnnotations{}
+	send(s, "POST", "/api/annotations", `{"target": "KAAA-1001", "text": "encoder replaced"}`)
+
+	assert.Contains(t, get(s, "/events?stream=KAAA-1001").Body.String(), "encoder replaced")
+	assert.NotContains(t, get(s, "/events?stream=KBBB-1002").Body.String(), "encoder replaced")
+	assert.NotContains(t, get(s, "/events").Body.String(), "encoder replaced")
+}
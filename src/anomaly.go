@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Sampled metrics.
+const (
+	metricActiveStreams = "active streams"
+	metricCatcherSlots  = "catcher slots used"
+	metricAdapterSlots  = "adapter slots used"
+)
+
+const (
+	defaultBaselineWeeks     = 4
+	defaultAnomalyDeviations = 3
+	// minBaselineSamples is how many past samples a baseline needs before it is trusted.
+	minBaselineSamples = 3
+	// minBandFraction keeps the band from collapsing onto the mean for metrics that rarely vary.
+	minBandFraction = 0.05
+)
+
+// Sample is a metric's value at a point in time.
+type Sample struct {
+	Time   time.Time `json:"time"`
+	Metric string    `json:"metric"`
+	Value  float64   `json:"value"`
+}
+
+// Band is the range a metric is expected to fall in.
+type Band struct {
+	Expected float64 `json:"expected"`
+	Lower    float64 `json:"lower"`
+	Upper    float64 `json:"upper"`
+	// Samples is how many past samples the band was built from.
+	Samples int `json:"samples"`
+}
+
+// baseline builds the band for at from the samples taken at the same hour on the same day of earlier
+// weeks, or at the same hour on any earlier day while there are too few of those. Samples from the
+// last half day are left out so an ongoing anomaly does not become its own baseline. It reports false
+// when there is not enough history for either.
+func baseline(history []*Sample, at time.Time, deviations float64) (*Band, bool) {
+	var sameDay, sameHour []float64
+	for _, s := range history {
+		if s.Time.Hour() != at.Hour() || at.Sub(s.Time) < 12*time.Hour {
+			continue
+		}
+		sameHour = append(sameHour, s.Value)
+		if s.Time.Weekday() == at.Weekday() {
+			sameDay = append(sameDay, s.Value)
+		}
+	}
+	vals := sameDay
+	if len(vals) < minBaselineSamples {
+		vals = sameHour
+	}
+	if len(vals) < minBaselineSamples {
+		return nil, false
+	}
+	var sum, sq float64
+	for _, v := range vals {
+		sum += v
+	}
+	mean := sum / float64(len(vals))
+	for _, v := range vals {
+		sq += (v - mean) * (v - mean)
+	}
+	margin := math.Max(deviations*math.Sqrt(sq/float64(len(vals))), minBandFraction*mean)
+	return &Band{Expected: mean, Lower: mean - margin, Upper: mean + margin, Samples: len(vals)}, true
+}
+
+// MetricStatus is a metric's latest sample judged against its baseline. Anomaly is drop or spike when
+// the sample falls outside the band, and empty otherwise or without a baseline.
+type MetricStatus struct {
+	Sample
+	Band    *Band  `json:"band,omitempty"`
+	Anomaly string `json:"anomaly,omitempty"`
+}
+
+func (ms *MetricStatus) String() string {
+	if ms.Band == nil {
+		return fmt.Sprintf("%s at %.0f, no baseline yet", ms.Metric, ms.Value)
+	}
+	switch ms.Anomaly {
+	case "drop":
+		return fmt.Sprintf("%s dropped to %.0f, expected %.0f (%.0f to %.0f)", ms.Metric, ms.Value, ms.Band.Expected, ms.Band.Lower, ms.Band.Upper)
+	case "spike":
+		return fmt.Sprintf("%s spiked to %.0f, expected %.0f (%.0f to %.0f)", ms.Metric, ms.Value, ms.Band.Expected, ms.Band.Lower, ms.Band.Upper)
+	}
+	return fmt.Sprintf("%s at %.0f, within %.0f to %.0f", ms.Metric, ms.Value, ms.Band.Lower, ms.Band.Upper)
+}
+
+func judge(s *Sample, history []*Sample, deviations float64) *MetricStatus {
+	ms := &MetricStatus{Sample: *s}
+	band, ok := baseline(history, s.Time, deviations)
+	if !ok {
+		return ms
+	}
+	ms.Band = band
+	switch {
+	case s.Value < band.Lower:
+		ms.Anomaly = "drop"
+	case s.Value > band.Upper:
+		ms.Anomaly = "spike"
+	}
+	return ms
+}
+
+// sampleStore is an append only file of samples, one json object per line, also held in memory for
+// as long as baselines look back.
+type sampleStore struct {
+	path    string
+	keep    time.Duration
+	mu      sync.Mutex
+	loaded  bool
+	samples []*Sample
+}
+
+func newSampleStore(path string, keep time.Duration) *sampleStore {
+	return &sampleStore{path: path, keep: keep}
+}
+
+// load reads the file the first time it is called. Call with mu held.
+func (st *sampleStore) load(now time.Time) error {
+	if st.loaded {
+		return nil
+	}
+	f, err := os.Open(st.path)
+	if os.IsNotExist(err) {
+		st.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cutoff := now.Add(-st.keep)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s := &Sample{}
+		if err := json.Unmarshal(scanner.Bytes(), s); err != nil {
+			log.Error("skipping bad sample %q in %s: %s", scanner.Text(), st.path, err)
+			continue
+		}
+		if !s.Time.Before(cutoff) {
+			st.samples = append(st.samples, s)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	st.loaded = true
+	return nil
+}
+
+// history returns metric's samples taken before t.
+func (st *sampleStore) history(metric string, t time.Time) ([]*Sample, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.load(t); err != nil {
+		return nil, err
+	}
+	var out []*Sample
+	for _, s := range st.samples {
+		if s.Metric == metric && s.Time.Before(t) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+func (st *sampleStore) append(samples []*Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.load(samples[0].Time); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(st.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, s := range samples {
+		if err := enc.Encode(s); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	cutoff := samples[len(samples)-1].Time.Add(-st.keep)
+	kept := st.samples[:0]
+	for _, s := range st.samples {
+		if !s.Time.Before(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	st.samples = append(kept, samples...)
+	return nil
+}
+
+// anomalyDetector judges new samples against their baselines and alerts when a metric leaves or
+// returns to its band.
+type anomalyDetector struct {
+	store      *sampleStore
+	deviations float64
+	alerts     *alerter
+	mu         sync.Mutex
+	status     map[string]*MetricStatus
+}
+
+func newAnomalyDetector(store *sampleStore, deviations float64, alerts *alerter) *anomalyDetector {
+	return &anomalyDetector{store: store, deviations: deviations, alerts: alerts, status: make(map[string]*MetricStatus)}
+}
+
+func (d *anomalyDetector) record(ctx context.Context, samples []*Sample) error {
+	var judged []*MetricStatus
+	for _, s := range samples {
+		history, err := d.store.history(s.Metric, s.Time)
+		if err != nil {
+			return err
+		}
+		judged = append(judged, judge(s, history, d.deviations))
+	}
+	d.mu.Lock()
+	var alerts []*Alert
+	for _, ms := range judged {
+		was := ""
+		if prev, ok := d.status[ms.Metric]; ok {
+			was = prev.Anomaly
+		}
+		d.status[ms.Metric] = ms
+		if ms.Anomaly != was && (ms.Anomaly != "" || ms.Band != nil) {
+			alerts = append(alerts, &Alert{Time: ms.Time, Source: "anomaly", Subject: ms.Metric, Message: ms.String(),
+				Resolved: ms.Anomaly == ""})
+		}
+	}
+	d.mu.Unlock()
+	for _, a := range alerts {
+		d.alerts.send(ctx, a)
+	}
+	return d.store.append(samples)
+}
+
+// current returns every metric's latest status, sorted by metric.
+func (d *anomalyDetector) current() []*MetricStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := []*MetricStatus{}
+	for _, ms := range d.status {
+		out = append(out, ms)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Metric < out[j].Metric
+	})
+	return out
+}
+
+// anomalous returns the metrics currently outside their bands.
+func (d *anomalyDetector) anomalous() []*MetricStatus {
+	var out []*MetricStatus
+	for _, ms := range d.current() {
+		if ms.Anomaly != "" {
+			out = append(out, ms)
+		}
+	}
+	return out
+}
+
+// sample takes one sample of every metric whose backend answered.
+func (s *server) sample(ctx context.Context, now time.Time) []*Sample {
+	r, _ := http.NewRequest("GET", "/api/anomalies", nil)
+	hd, err := s.fetch(r.WithContext(ctx), partCatchers, partAdapters)
+	if err != nil {
+		log.Error("could not sample %s", err)
+		return nil
+	}
+	missing := make(map[string]bool)
+	for _, d := range hd.Degraded {
+		missing[d.Source] = true
+	}
+	var samples []*Sample
+	if !missing[partNames[partCatchers]] {
+		used := 0
+		for _, c := range hd.Catchers {
+			used += len(c.Streams)
+		}
+		samples = append(samples, &Sample{Time: now, Metric: metricCatcherSlots, Value: float64(used)})
+	}
+	if !missing[partNames[partAdapters]] {
+		used := 0
+		for _, a := range hd.Adapters {
+			used += len(a.Streams)
+		}
+		samples = append(samples, &Sample{Time: now, Metric: metricAdapterSlots, Value: float64(used)})
+	}
+	var count int
+	err = s.call(ctx, partTranscoders, func(ctx context.Context) (err error) {
+		count, err = s.transcoders.ActiveStreamCount(ctx, lastWindow(s.transcoderWindow, now))
+		return err
+	})
+	if err != nil {
+		log.Warning("not sampling %s: %s", metricActiveStreams, err)
+	} else {
+		samples = append(samples, &Sample{Time: now, Metric: metricActiveStreams, Value: float64(count)})
+	}
+	return samples
+}
+
+// runSampler samples every interval until ctx ends.
+func (s *server) runSampler(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := s.anomalies.record(ctx, s.sample(ctx, time.Now())); err != nil {
+			log.Error("could not record samples %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *server) AnomaliesJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.anomalies == nil {
+		http.Error(w, "no sample log configured", http.StatusNotFound)
+		return
+	}
+	serveJson(w, s.anomalies.current())
+}
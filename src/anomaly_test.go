@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingNotifier keeps the alerts it is sent.
+type recordingNotifier struct {
+	mu     sync.Mutex
+	alerts []*Alert
+}
+
+func (n *recordingNotifier) notify(_ context.Context, a *Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.alerts = append(n.alerts, a)
+	return nil
+}
+
+// weeklyHistory returns a sample at at's hour on each of the previous weeks, and at other hours in
+// between.
+func weeklyHistory(metric string, at time.Time, vals ...float64) []*Sample {
+	var h []*Sample
+	for i, v := range vals {
+		t := at.AddDate(0, 0, -7*(i+1))
+		h = append(h, &Sample{Time: t, Metric: metric, Value: v}, &Sample{Time: t.Add(6 * time.Hour), Metric: metric, Value: 10 * v})
+	}
+	return h
+}
+
+func TestBaseline(t *testing.T) {
+	at := time.Date(2026, 3, 4, 2, 0, 0, 0, time.Local)
+	_, ok := baseline(weeklyHistory(metricActiveStreams, at, 100, 100), at, 3)
+	assert.False(t, ok, "two samples are not a baseline")
+
+	band, ok := baseline(weeklyHistory(metricActiveStreams, at, 98, 100, 102, 100), at, 3)
+	assert.True(t, ok)
+	assert.InDelta(t, 100, band.Expected, 0.001)
+	assert.InDelta(t, 95, band.Lower, 0.001, "the minimum band applies when deviation is small")
+	assert.Equal(t, 4, band.Samples)
+
+	assert.Equal(t, "drop", judge(&Sample{Time: at, Value: 80}, weeklyHistory("", at, 98, 100, 102), 3).Anomaly)
+	assert.Equal(t, "spike", judge(&Sample{Time: at, Value: 130}, weeklyHistory("", at, 98, 100, 102), 3).Anomaly)
+	assert.Equal(t, "", judge(&Sample{Time: at, Value: 97}, weeklyHistory("", at, 98, 100, 102), 3).Anomaly)
+
+	// Other days at the same hour fill in for a short history.
+	daily := []*Sample{
+		{Time: at.AddDate(0, 0, -1), Value: 100}, {Time: at.AddDate(0, 0, -2), Value: 100}, {Time: at.AddDate(0, 0, -7), Value: 100},
+	}
+	band, ok = baseline(daily, at, 3)
+	assert.True(t, ok)
+	assert.Equal(t, 3, band.Samples)
+}
+
+func TestAnomalyAlerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samples")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "samples.jsonl")
+
+	at := time.Date(2026, 3, 4, 2, 0, 0, 0, time.Local)
+	st := newSampleStore(path, 4*7*24*time.Hour)
+	assert.Nil(t, st.append(weeklyHistory(metricActiveStreams, at, 100, 100, 100)))
+
+	n := &recordingNotifier{}
+	d := newAnomalyDetector(newSampleStore(path, 4*7*24*time.Hour), 3, &alerter{notifiers: []notifier{n}})
+	assert.Nil(t, d.record(context.Background(), []*Sample{{Time: at, Metric: metricActiveStreams, Value: 100}}))
+	assert.Empty(t, n.alerts)
+	assert.Empty(t, d.anomalous())
+
+	assert.Nil(t, d.record(context.Background(), []*Sample{{Time: at.Add(time.Minute), Metric: metricActiveStreams, Value: 80}}))
+	assert.Nil(t, d.record(context.Background(), []*Sample{{Time: at.Add(2 * time.Minute), Metric: metricActiveStreams, Value: 79}}))
+	if assert.Len(t, n.alerts, 1, "only the change into an anomaly alerts") {
+		assert.False(t, n.alerts[0].Resolved)
+		assert.Contains(t, n.alerts[0].Message, "active streams dropped to 80")
+	}
+	assert.Len(t, d.anomalous(), 1)
+
+	assert.Nil(t, d.record(context.Background(), []*Sample{{Time: at.Add(3 * time.Minute), Metric: metricActiveStreams, Value: 99}}))
+	if assert.Len(t, n.alerts, 2) {
+		assert.True(t, n.alerts[1].Resolved)
+	}
+
+	history, err := newSampleStore(path, 4*7*24*time.Hour).history(metricActiveStreams, at.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Len(t, history, 10, "samples are persisted")
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got struct {
+		Text  string
+		Alert *Alert
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer ts.Close()
+
+	a := &Alert{Source: "anomaly", Subject: metricActiveStreams, Message: "active streams dropped to 80"}
+	n := &webhookNotifier{url: ts.URL, client: ts.Client()}
+	assert.Nil(t, n.notify(context.Background(), a))
+	assert.Equal(t, "[ALERT] anomaly active streams: active streams dropped to 80", got.Text)
+	assert.Equal(t, metricActiveStreams, got.Alert.Subject)
+
+	ts.Close()
+	assert.NotNil(t, n.notify(context.Background(), a))
+}
+
+func TestSampleAndDashboard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samples")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := testServer(t)
+	assert.Equal(t, http.StatusNotFound, get(s, "/api/anomalies").Code)
+
+	now := time.Now()
+	s.anomalies = newAnomalyDetector(newSampleStore(filepath.Join(dir, "samples.jsonl"), 28*24*time.Hour), 3, &alerter{})
+	assert.Nil(t, s.anomalies.store.append(weeklyHistory(metricCatcherSlots, now, 10, 10, 10)))
+	samples := s.sample(context.Background(), now)
+	got := make(map[string]float64)
+	for _, smp := range samples {
+		got[smp.Metric] = smp.Value
+	}
+	assert.Equal(t, map[string]float64{metricActiveStreams: 6, metricCatcherSlots: 7, metricAdapterSlots: 6}, got)
+	assert.Nil(t, s.anomalies.record(context.Background(), samples))
+
+	var statuses []*MetricStatus
+	assert.Nil(t, json.Unmarshal(get(s, "/api/anomalies").Body.Bytes(), &statuses))
+	assert.Len(t, statuses, 3)
+	assert.Contains(t, get(s, "/").Body.String(), "catcher slots used dropped to 7")
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/garyburd/redigo/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Audit actions.
+const (
+	auditWrite    = "write"
+	auditRollback = "rollback"
+)
+
+const (
+	defaultAuditLimit  = 500
+	defaultAuditWindow = 7 * 24 * time.Hour
+)
+
+var (
+	errNoUser        = errors.New("writes need a user")
+	errCrossOrigin   = errors.New("writes must come from the dashboard's own pages")
+	errEntryNotFound = errors.New("no such journal entry")
+	errWriteRace     = errors.New("keys changed while writing, nothing was written")
+)
+
+// Change is one value written through the dashboard: a nameservice:stream: or nameservice:activehost:
+// key, or a field of the configured ns:redirect: hash. A nil Old or New is a key or field that does not
+// exist.
+type Change struct {
+	Key   string  `json:"key"`
+	Field string  `json:"field,omitempty"`
+	Old   *string `json:"old"`
+	New   *string `json:"new"`
+}
+
+// validate checks c is to a key the dashboard may write, redirectHash being the only redirect hash,
+// and that its new value is one the readers of that key understand.
+func (c *Change) validate(redirectHash string) error {
+	switch {
+	case strings.HasPrefix(c.Key, streamKey) && len(c.Key) > len(streamKey):
+		if c.Field != "" {
+			return fmt.Errorf("%s is not a hash", c.Key)
+		}
+		if c.New != nil && net.ParseIP(*c.New) == nil {
+			return fmt.Errorf("%s must name a catcher ip, not %q", c.Key, *c.New)
+		}
+	case strings.HasPrefix(c.Key, activeHostKey) && len(c.Key) > len(activeHostKey):
+		if c.Field != "" {
+			return fmt.Errorf("%s is not a hash", c.Key)
+		}
+		if c.New != nil && (*c.New == "" || strings.ContainsAny(*c.New, " \t\r\n")) {
+			return fmt.Errorf("%s must name a host, not %q", c.Key, *c.New)
+		}
+	case c.Key == redirectHash:
+		if c.Field == "" {
+			return fmt.Errorf("%s needs a field", c.Key)
+		}
+		if c.New != nil && json.Unmarshal([]byte(*c.New), &RedirectHost{}) != nil {
+			return fmt.Errorf("%s %s must be a redirect host's json, not %q", c.Key, c.Field, *c.New)
+		}
+	default:
+		return fmt.Errorf("%q is not a %s, %s or %s key", c.Key, streamKey, activeHostKey, redirectHash)
+	}
+	return nil
+}
+
+// Target is the key, and the field when there is one.
+func (c *Change) Target() string {
+	if c.Field == "" {
+		return c.Key
+	}
+	return c.Key + " " + c.Field
+}
+
+// Conflict is a key whose value is not what a rollback expected to find.
+type Conflict struct {
+	Key      string  `json:"key"`
+	Field    string  `json:"field,omitempty"`
+	Expected *string `json:"expected"`
+	Current  *string `json:"current"`
+}
+
+func (c *Conflict) String() string {
+	return fmt.Sprintf("%s changed since, expected %s found %s", (&Change{Key: c.Key, Field: c.Field}).Target(),
+		quoted(c.Expected), quoted(c.Current))
+}
+
+func quoted(v *string) string {
+	if v == nil {
+		return "nothing"
+	}
+	return strconv.Quote(*v)
+}
+
+func sameValue(a, b *string) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+// settle compares the current values with the changes before they are written. With check set the
+// keys that differ from their change's Old are conflicts; without it Old is filled in.
+func settle(changes []*Change, current []*string, check bool) []*Conflict {
+	var conflicts []*Conflict
+	for i, c := range changes {
+		if !check {
+			c.Old = current[i]
+		} else if !sameValue(current[i], c.Old) {
+			conflicts = append(conflicts, &Conflict{Key: c.Key, Field: c.Field, Expected: c.Old, Current: current[i]})
+		}
+	}
+	return conflicts
+}
+
+// AuditEntry is one write through the dashboard as recorded in the journal.
+type AuditEntry struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Action  string    `json:"action"`
+	Changes []*Change `json:"changes"`
+	// RollbackOf is the id of the entry a rollback restored.
+	RollbackOf string `json:"rollbackOf,omitempty"`
+}
+
+// auditStore writes the keys the dashboard may change and keeps the journal of those writes. A write
+// and its journal entry are made together or not at all.
+type auditStore interface {
+	// apply writes every change in e and appends e to the journal in one transaction. With check set
+	// nothing is written if any current value differs from its change's Old, and the differences are
+	// returned. Without it Old is filled in with the value replaced.
+	apply(ctx context.Context, e *AuditEntry, check bool) ([]*Conflict, error)
+	// entries returns the newest entries matching f, newest first.
+	entries(ctx context.Context, f *auditFilter) ([]*AuditEntry, error)
+}
+
+// memAudit keeps the keys and journal in memory. It serves demo mode and tests.
+type memAudit struct {
+	mu      sync.Mutex
+	vals    map[string]string
+	journal []*AuditEntry
+}
+
+func newMemAudit() *memAudit {
+	return &memAudit{vals: make(map[string]string)}
+}
+
+func (m *memAudit) apply(_ context.Context, e *AuditEntry, check bool) ([]*Conflict, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := make([]*string, len(e.Changes))
+	for i, c := range e.Changes {
+		if v, ok := m.vals[c.Target()]; ok {
+			current[i] = &v
+		}
+	}
+	if conflicts := settle(e.Changes, current, check); len(conflicts) > 0 {
+		return conflicts, nil
+	}
+	for _, c := range e.Changes {
+		if c.New == nil {
+			delete(m.vals, c.Target())
+		} else {
+			m.vals[c.Target()] = *c.New
+		}
+	}
+	m.journal = append(m.journal, e)
+	return nil, nil
+}
+
+func (m *memAudit) entries(_ context.Context, f *auditFilter) ([]*AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []*AuditEntry{}
+	for i := len(m.journal) - 1; i >= 0 && !f.full(entries); i-- {
+		if f.match(m.journal[i]) {
+			entries = append(entries, m.journal[i])
+		}
+	}
+	return entries, nil
+}
+
+// maxWriteAttempts is how many times a write is tried before giving up on keys that keep changing.
+const maxWriteAttempts = 5
+
+// journalPage is how many journal entries are read from redis at a time.
+const journalPage = 500
+
+// journalSkew is how far out of time order instances with different clocks may append entries.
+const journalSkew = 5 * time.Minute
+
+// redisAudit writes the nameservice keys and redirect hash and journals the writes in a redis list, so
+// every instance shares one journal. The keys are watched while they are read and the entry is pushed
+// in the same transaction as the write, so a write racing another client is never recorded with the
+// wrong old values.
+type redisAudit struct {
+	redisServer
+	key string
+}
+
+func newRedisAudit(rs redisServer, key string) *redisAudit {
+	return &redisAudit{redisServer: rs, key: key}
+}
+
+// apply retries a transaction abandoned because a watched key changed. The redirect hash is watched
+// as a whole but redirect hosts keep writing their own fields, so only the changed fields are compared
+// on each attempt and a change elsewhere in the hash just means trying again.
+func (db *redisAudit) apply(ctx context.Context, e *AuditEntry, check bool) ([]*Conflict, error) {
+	conn, err := db.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for i := 0; i < maxWriteAttempts; i++ {
+		conflicts, err := db.transact(conn, e, check)
+		if err != errWriteRace {
+			return conflicts, ctxErr(ctx, err)
+		}
+	}
+	return nil, errWriteRace
+}
+
+func (db *redisAudit) transact(conn redis.Conn, e *AuditEntry, check bool) ([]*Conflict, error) {
+	var keys []interface{}
+	for _, c := range e.Changes {
+		keys = append(keys, c.Key)
+	}
+	if _, err := conn.Do("WATCH", keys...); err != nil {
+		return nil, err
+	}
+	current := make([]*string, len(e.Changes))
+	for i, c := range e.Changes {
+		var v string
+		var err error
+		if c.Field == "" {
+			v, err = redis.String(conn.Do("GET", c.Key))
+		} else {
+			v, err = redis.String(conn.Do("HGET", c.Key, c.Field))
+		}
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		current[i] = &v
+	}
+	if conflicts := settle(e.Changes, current, check); len(conflicts) > 0 {
+		_, err := conn.Do("UNWATCH")
+		return conflicts, err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		conn.Do("UNWATCH")
+		return nil, err
+	}
+	conn.Send("MULTI")
+	for _, c := range e.Changes {
+		switch {
+		case c.Field == "" && c.New == nil:
+			conn.Send("DEL", c.Key)
+		case c.Field == "":
+			conn.Send("SET", c.Key, *c.New)
+		case c.New == nil:
+			conn.Send("HDEL", c.Key, c.Field)
+		default:
+			conn.Send("HSET", c.Key, c.Field, *c.New)
+		}
+	}
+	conn.Send("RPUSH", db.key, b)
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errWriteRace
+	}
+	return nil, nil
+}
+
+// entries reads the journal a page at a time from the newest end. Entries are appended in about time
+// order, so reading stops at the first page reaching back journalSkew before f's window.
+func (db *redisAudit) entries(ctx context.Context, f *auditFilter) ([]*AuditEntry, error) {
+	n, err := redis.Int(db.do(ctx, "LLEN", db.key))
+	if err != nil {
+		return nil, err
+	}
+	entries := []*AuditEntry{}
+	for stop := n - 1; stop >= 0 && !f.full(entries); stop -= journalPage {
+		start := stop - journalPage + 1
+		if start < 0 {
+			start = 0
+		}
+		vals, err := redis.Strings(db.do(ctx, "LRANGE", db.key, start, stop))
+		if err != nil {
+			return nil, err
+		}
+		before := false
+		for i := len(vals) - 1; i >= 0 && !f.full(entries); i-- {
+			e := &AuditEntry{}
+			if err := json.Unmarshal([]byte(vals[i]), e); err != nil {
+				log.Error("skipping bad journal entry %q in %s: %s", vals[i], db.key, err)
+				continue
+			}
+			if f.match(e) {
+				entries = append(entries, e)
+			}
+			before = before || (!f.window.To.IsZero() && e.Time.Before(f.window.From.Add(-journalSkew)))
+		}
+		if before {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// auditFilter selects journal entries. Empty fields, and a zero window, match everything; key matches
+// part of a target.
+type auditFilter struct {
+	window window
+	user   string
+	key    string
+	id     string
+	limit  int
+}
+
+func (f *auditFilter) match(e *AuditEntry) bool {
+	if (f.id != "" && e.ID != f.id) || (f.user != "" && e.User != f.user) || (!f.window.To.IsZero() && !f.window.contains(e.Time)) {
+		return false
+	}
+	if f.key == "" {
+		return true
+	}
+	for _, c := range e.Changes {
+		if strings.Contains(c.Target(), f.key) {
+			return true
+		}
+	}
+	return false
+}
+
+// full reports whether entries has reached f's limit.
+func (f *auditFilter) full(entries []*AuditEntry) bool {
+	return f.limit > 0 && len(entries) >= f.limit
+}
+
+// auditor makes every write to the nameservice and redirect keys through the journal. The user making
+// a write is taken from userHeader, which the proxy in front of the dashboard sets. Anyone can send the
+// header, so it is only believed from the proxies' addresses. redirectHash is the one redirect hash
+// writes may change.
+type auditor struct {
+	store        auditStore
+	userHeader   string
+	redirectHash string
+	proxies      []*net.IPNet
+}
+
+func newAuditor(store auditStore, userHeader, redirectHash string, proxies []*net.IPNet) *auditor {
+	if userHeader == "" {
+		userHeader = "X-Forwarded-User"
+	}
+	return &auditor{store: store, userHeader: userHeader, redirectHash: redirectHash, proxies: proxies}
+}
+
+// parseProxies reads proxy addresses given as ips or cidr ranges.
+func parseProxies(vals []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range vals {
+		if ip := net.ParseIP(v); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an ip or cidr range", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trusted reports whether r came from one of the proxies.
+func (a *auditor) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, n := range a.proxies {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// user returns the user the proxy named in r, or "" if r did not come through a trusted proxy.
+func (a *auditor) user(r *http.Request) string {
+	if !a.trusted(r) {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(a.userHeader))
+}
+
+// sameOrigin reports whether a write was sent by the dashboard's own pages rather than by another
+// site the user's browser is on, which would otherwise write as them through the proxy. Browsers name
+// the page a post came from in Origin, or failing that Referer; requests with neither are not from a
+// browser page and are let through. The host is the one a trusted proxy was asked for.
+func (a *auditor) sameOrigin(r *http.Request) bool {
+	from := r.Header.Get("Origin")
+	if from == "" {
+		from = r.Header.Get("Referer")
+	}
+	if from == "" {
+		return true
+	}
+	u, err := url.Parse(from)
+	if err != nil {
+		return false
+	}
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" && a.trusted(r) {
+		host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	return strings.EqualFold(u.Host, host)
+}
+
+// validate checks there is something to write and that every change is to a key the dashboard may
+// write.
+func (a *auditor) validate(changes []*Change) error {
+	if len(changes) == 0 {
+		return fmt.Errorf("nothing to write")
+	}
+	for _, c := range changes {
+		if err := c.validate(a.redirectHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write applies changes as user and journals them with the values they replaced. Write features
+// must go through here rather than to redis directly.
+func (a *auditor) write(ctx context.Context, user string, changes []*Change) (*AuditEntry, error) {
+	if user == "" {
+		return nil, errNoUser
+	}
+	if err := a.validate(changes); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	e := &AuditEntry{ID: strconv.FormatInt(now.UnixNano(), 10), Time: now, User: user, Action: auditWrite, Changes: changes}
+	if _, err := a.store.apply(ctx, e, false); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// rollback restores the old values recorded in entry id, as user. If any key no longer holds the
+// value the entry wrote nothing is restored and the conflicts are returned.
+func (a *auditor) rollback(ctx context.Context, user, id string) (*AuditEntry, []*Conflict, error) {
+	if user == "" {
+		return nil, nil, errNoUser
+	}
+	// ids are the writer's clock, which need not agree with other instances', so the whole journal is
+	// searched rather than just back to the id's time
+	found, err := a.store.entries(ctx, &auditFilter{id: id, limit: 1})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(found) == 0 {
+		return nil, nil, errEntryNotFound
+	}
+	orig := found[0]
+	var changes []*Change
+	for i := len(orig.Changes) - 1; i >= 0; i-- {
+		c := orig.Changes[i]
+		changes = append(changes, &Change{Key: c.Key, Field: c.Field, Old: c.New, New: c.Old})
+	}
+	now := time.Now()
+	e := &AuditEntry{ID: strconv.FormatInt(now.UnixNano(), 10), Time: now, User: user, Action: auditRollback, Changes: changes,
+		RollbackOf: orig.ID}
+	conflicts, err := a.store.apply(ctx, e, true)
+	if err != nil || len(conflicts) > 0 {
+		return nil, conflicts, err
+	}
+	log.Info("%s rolled back %s by %s", user, orig.ID, orig.User)
+	return e, nil, nil
+}
+
+// AuditDisplay is the journal page.
+type AuditDisplay struct {
+	Entries []*AuditEntry
+	Window  window
+	Since   string
+	From    string
+	To      string
+	User    string
+	Key     string
+}
+
+// auditEntries reads the journal entries asked for by r's query, writing an error response if it cannot.
+func (s *server) auditEntries(w http.ResponseWriter, r *http.Request) (*AuditDisplay, bool) {
+	if s.audit == nil {
+		http.Error(w, "no audit journal configured", http.StatusNotFound)
+		return nil, false
+	}
+	win, ok := s.window(w, r, defaultAuditWindow)
+	if !ok {
+		return nil, false
+	}
+	q := r.URL.Query()
+	f := &auditFilter{window: win, user: q.Get("user"), key: q.Get("key"), limit: defaultAuditLimit}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return nil, false
+		}
+		f.limit = n
+	}
+	entries, err := s.audit.store.entries(r.Context(), f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return &AuditDisplay{Entries: entries, Window: win, Since: q.Get("since"), From: q.Get("from"), To: q.Get("to"),
+		User: f.user, Key: f.key}, true
+}
+
+func (s *server) Audit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ad, ok := s.auditEntries(w, r)
+	if !ok {
+		return
+	}
+	err := templates.ExecuteTemplate(w, "audit.html", ad)
+	if err != nil {
+		log.Error("error executing template %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *server) AuditJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ad, ok := s.auditEntries(w, r)
+	if !ok {
+		return
+	}
+	serveJson(w, ad.Entries)
+}
+
+// rollback rolls back the entry in the path as the request's user, writing an error response if it
+// fails. Conflicts are left for the caller to report.
+func (s *server) rollback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (*AuditEntry, []*Conflict, bool) {
+	if s.audit == nil {
+		http.Error(w, "no audit journal configured", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if !s.audit.sameOrigin(r) {
+		http.Error(w, errCrossOrigin.Error(), http.StatusForbidden)
+		return nil, nil, false
+	}
+	e, conflicts, err := s.audit.rollback(r.Context(), s.audit.user(r), ps.ByName("id"))
+	switch {
+	case err == errNoUser:
+		http.Error(w, s.audit.noUser(), http.StatusUnauthorized)
+	case err == errEntryNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err == errWriteRace:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		return e, conflicts, true
+	}
+	return nil, nil, false
+}
+
+func (a *auditor) noUser() string {
+	return fmt.Sprintf("%s, no %s header from a trusted proxy", errNoUser, a.userHeader)
+}
+
+// RollbackJSON restores the old values of a journal entry and serves the rollback's own entry, or the
+// conflicting keys as 409 if any changed since.
+func (s *server) RollbackJSON(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	e, conflicts, ok := s.rollback(w, r, ps)
+	if !ok {
+		return
+	}
+	if len(conflicts) > 0 {
+		b, _ := json.Marshal(struct {
+			Conflicts []*Conflict `json:"conflicts"`
+		}{conflicts})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(b)
+		return
+	}
+	serveJson(w, e)
+}
+
+// Rollback is the journal page's rollback button. It returns to the journal once done.
+func (s *server) Rollback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	_, conflicts, ok := s.rollback(w, r, ps)
+	if !ok {
+		return
+	}
+	if len(conflicts) > 0 {
+		lines := []string{"nothing was rolled back:"}
+		for _, c := range conflicts {
+			lines = append(lines, c.String())
+		}
+		http.Error(w, strings.Join(lines, "\n"), http.StatusConflict)
+		return
+	}
+	http.Redirect(w, r, "/audit", http.StatusSeeOther)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func strp(s string) *string {
+	return &s
+}
+
+// auditServer trusts the address httptest requests come from.
+func auditServer(t *testing.T) *server {
+	s := testServer(t)
+	proxies, err := parseProxies([]string{"192.0.2.0/24"})
+	assert.Nil(t, err)
+	s.audit = newAuditor(newMemAudit(), "", redirectKey+"prod", proxies)
+	return s
+}
+
+func sendAs(s *server, user, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if user != "" {
+		r.Header.Set("X-Forwarded-User", user)
+	}
+	s.routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestChangeValidate(t *testing.T) {
+	hash := redirectKey + "prod"
+	for _, c := range []*Change{
+		{Key: streamKey + "KAAA-1001"},
+		{Key: streamKey + "KAAA-1001", New: strp("10.10.1.11")},
+		{Key: activeHostKey + "KAAA-1001", New: strp("catcher01")},
+		{Key: hash, Field: "redirect01"},
+		{Key: hash, Field: "redirect01", New: strp(`{"streams": 1, "max": 40}`)},
+	} {
+		assert.Nil(t, c.validate(hash), c.Target())
+	}
+	for _, c := range []*Change{
+		{Key: streamKey},
+		{Key: streamKey + "KAAA-1001", Field: "x"},
+		{Key: streamKey + "KAAA-1001", New: strp("catcher01")},
+		{Key: activeHostKey + "KAAA-1001", New: strp("")},
+		{Key: hash},
+		{Key: hash, Field: "redirect01", New: strp("up")},
+		{Key: redirectKey + "qa", Field: "redirect01"},
+		{Key: hostTypeKey + "catcher01"},
+	} {
+		assert.NotNil(t, c.validate(hash), c.Target())
+	}
+}
+
+func TestAuditWriteAndRollback(t *testing.T) {
+	s := auditServer(t)
+	ctx := context.Background()
+	keys := s.audit.store.(*memAudit)
+
+	_, err := s.audit.write(ctx, "", []*Change{{Key: streamKey + "KAAA-1001", New: strp("10.10.1.11")}})
+	assert.Equal(t, errNoUser, err)
+	_, err = s.audit.write(ctx, "ana", []*Change{{Key: "hosttype:x", New: strp("720p")}})
+	assert.NotNil(t, err)
+
+	first, err := s.audit.write(ctx, "ana", []*Change{{Key: streamKey + "KAAA-1001", New: strp("10.10.1.11")}})
+	assert.Nil(t, err)
+	assert.Nil(t, first.Changes[0].Old)
+	move, err := s.audit.write(ctx, "ben", []*Change{
+		{Key: streamKey + "KAAA-1001", New: strp("10.10.1.12")},
+		{Key: redirectKey + "prod", Field: "redirect01", New: strp(`{"streams": 1}`)},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, strp("10.10.1.11"), move.Changes[0].Old)
+
+	var entries []*AuditEntry
+	assert.Nil(t, json.Unmarshal(get(s, "/api/audit").Body.Bytes(), &entries))
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, move.ID, entries[0].ID, "newest first")
+	}
+	entries = nil
+	assert.Nil(t, json.Unmarshal(get(s, "/api/audit?user=ana").Body.Bytes(), &entries))
+	assert.Len(t, entries, 1)
+	entries = nil
+	assert.Nil(t, json.Unmarshal(get(s, "/api/audit?key=redirect01").Body.Bytes(), &entries))
+	assert.Len(t, entries, 1)
+
+	body := get(s, "/audit").Body.String()
+	assert.Contains(t, body, "10.10.1.12")
+	assert.Contains(t, body, "/audit/"+move.ID+"/rollback")
+
+	assert.Equal(t, http.StatusUnauthorized, sendAs(s, "", "POST", "/api/audit/"+move.ID+"/rollback", "").Code)
+	assert.Equal(t, http.StatusNotFound, sendAs(s, "cho", "POST", "/api/audit/1/rollback", "").Code)
+
+	w := sendAs(s, "cho", "POST", "/api/audit/"+move.ID+"/rollback", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	rb := &AuditEntry{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), rb))
+	assert.Equal(t, auditRollback, rb.Action)
+	assert.Equal(t, move.ID, rb.RollbackOf)
+	assert.Equal(t, "cho", rb.User)
+	assert.Equal(t, map[string]string{streamKey + "KAAA-1001": "10.10.1.11"}, keys.vals)
+
+	// rolling back again finds the keys no longer hold what the entry wrote
+	w = sendAs(s, "cho", "POST", "/api/audit/"+move.ID+"/rollback", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	var resp struct {
+		Conflicts []*Conflict `json:"conflicts"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Conflicts, 2)
+	assert.Equal(t, map[string]string{streamKey + "KAAA-1001": "10.10.1.11"}, keys.vals, "nothing is written on conflict")
+
+	w = sendAs(s, "cho", "POST", "/audit/"+move.ID+"/rollback", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `expected "10.10.1.12" found "10.10.1.11"`)
+
+	w = sendAs(s, "cho", "POST", "/audit/"+rb.ID+"/rollback", "")
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "10.10.1.12", keys.vals[streamKey+"KAAA-1001"])
+
+	entries = nil
+	assert.Nil(t, json.Unmarshal(get(s, "/api/audit").Body.Bytes(), &entries))
+	assert.Len(t, entries, 4, "conflicting rollbacks are not journaled")
+}
+
+func TestAuditUser(t *testing.T) {
+	proxies, err := parseProxies([]string{"10.0.0.5", "192.0.2.0/24", "::1"})
+	assert.Nil(t, err)
+	a := newAuditor(newMemAudit(), "", redirectKey+"prod", proxies)
+	for addr, want := range map[string]string{
+		"10.0.0.5:4000":     "ana",
+		"192.0.2.77:4000":   "ana",
+		"[::1]:4000":        "ana",
+		"10.0.0.6:4000":     "",
+		"198.51.100.1:4000": "",
+	} {
+		r := httptest.NewRequest("POST", "/api/audit/1/rollback", nil)
+		r.RemoteAddr = addr
+		r.Header.Set("X-Forwarded-User", " ana ")
+		assert.Equal(t, want, a.user(r), addr)
+	}
+	_, err = parseProxies([]string{"proxy01"})
+	assert.NotNil(t, err)
+}
+
+// filterLog records the filters entries are read with.
+type filterLog struct {
+	*memAudit
+	filters []*auditFilter
+}
+
+func (l *filterLog) entries(ctx context.Context, f *auditFilter) ([]*AuditEntry, error) {
+	l.filters = append(l.filters, f)
+	return l.memAudit.entries(ctx, f)
+}
+
+func TestRollbackFindsEntryByID(t *testing.T) {
+	store := &filterLog{memAudit: newMemAudit()}
+	a := newAuditor(store, "", redirectKey+"prod", nil)
+	ctx := context.Background()
+	e, err := a.write(ctx, "ana", []*Change{{Key: streamKey + "KAAA-1001", New: strp("10.10.1.11")}})
+	assert.Nil(t, err)
+	// another instance's clock ran ahead, so the entry's id is later than its place in the journal
+	e.ID = strconv.FormatInt(time.Now().Add(time.Hour).UnixNano(), 10)
+
+	_, conflicts, err := a.rollback(ctx, "ben", e.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, conflicts)
+	if assert.Len(t, store.filters, 1) {
+		assert.True(t, store.filters[0].window.To.IsZero(), "the whole journal is searched")
+	}
+}
+
+func TestRollbackSameOrigin(t *testing.T) {
+	s := auditServer(t)
+	ctx := context.Background()
+	var ids []string
+	for _, ip := range []string{"10.10.1.11", "10.10.1.12"} {
+		e, err := s.audit.write(ctx, "ana", []*Change{{Key: streamKey + "KAAA-1001", New: strp(ip)}})
+		assert.Nil(t, err)
+		ids = append(ids, e.ID)
+	}
+	rollback := func(id string, headers map[string]string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/audit/"+id+"/rollback", nil)
+		r.Header.Set("X-Forwarded-User", "ben")
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		s.routes().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, rollback(ids[1], map[string]string{"Origin": "https://elsewhere.example"}))
+	assert.Equal(t, http.StatusForbidden, rollback(ids[1], map[string]string{"Referer": "https://elsewhere.example/page"}))
+	assert.Equal(t, "10.10.1.12", s.audit.store.(*memAudit).vals[streamKey+"KAAA-1001"], "nothing is rolled back")
+
+	assert.Equal(t, http.StatusSeeOther, rollback(ids[1], map[string]string{"Origin": "http://example.com"}))
+	assert.Equal(t, http.StatusSeeOther, rollback(ids[0], map[string]string{
+		"Referer": "https://dashboard.example/audit", "X-Forwarded-Host": "dashboard.example"}))
+	assert.Empty(t, s.audit.store.(*memAudit).vals)
+
+	s.audit.proxies = nil
+	assert.False(t, s.audit.sameOrigin(func() *http.Request {
+		r := httptest.NewRequest("POST", "/audit/1/rollback", nil)
+		r.Header.Set("Origin", "https://dashboard.example")
+		r.Header.Set("X-Forwarded-Host", "dashboard.example")
+		return r
+	}()), "the forwarded host is only believed from a proxy")
+}
+
+func TestRedisAuditUnreachable(t *testing.T) {
+	l := silentRedis(t)
+	defer l.Close()
+
+	s := testServer(t)
+	s.audit = newAuditor(newRedisAudit(redisServer{addr: l.Addr().String(), timeout: 50 * time.Millisecond}, "audit"), "", redirectKey+"prod", nil)
+	_, err := s.audit.write(context.Background(), "ana", []*Change{{Key: streamKey + "KAAA-1001", New: strp("10.10.1.11")}})
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, get(s, "/api/audit").Code)
+	assert.Equal(t, http.StatusNotFound, get(testServer(t), "/api/audit").Code)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+)
+
+// maxBlackout bounds how long a single blackout may last, which is also how far back offlineAt looks
+// for the start of one.
+const maxBlackout = 7 * 24 * time.Hour
+
+// Blackout is a recurring window when a station is expected to be off the air. Schedule is a five
+// field cron expression (minute hour day-of-month month day-of-week) for when the window starts, read
+// in Timezone, which defaults to the station's catalog timezone and then to the server's zone.
+type Blackout struct {
+	Schedule string `json:"schedule"`
+	Duration string `json:"duration"`
+	Timezone string `json:"timezone,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// compiledBlackout is a Blackout ready to be checked.
+type compiledBlackout struct {
+	*Blackout
+	cron     *cronSchedule
+	duration time.Duration
+	loc      *time.Location
+}
+
+func (b *Blackout) compile() (*compiledBlackout, error) {
+	cron, err := parseCron(b.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	d, err := time.ParseDuration(b.Duration)
+	if err != nil || d < time.Minute || d > maxBlackout {
+		return nil, fmt.Errorf("duration %q must be between 1m and %s", b.Duration, maxBlackout)
+	}
+	loc := time.Local
+	if b.Timezone != "" {
+		if loc, err = time.LoadLocation(b.Timezone); err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", b.Timezone)
+		}
+	}
+	return &compiledBlackout{Blackout: b, cron: cron, duration: d, loc: loc}, nil
+}
+
+// offlineAt reports whether t falls in a window of b and, if so, when that window ends.
+func (b *compiledBlackout) offlineAt(t time.Time) (time.Time, bool) {
+	minute := t.In(b.loc).Truncate(time.Minute)
+	for back := time.Duration(0); back < b.duration; back += time.Minute {
+		start := minute.Add(-back)
+		if !b.cron.matches(start) {
+			continue
+		}
+		if end := start.Add(b.duration); t.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// cronSchedule is a parsed five field cron expression.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	// domAny and dowAny record a * day field; when both day fields are restricted either may match.
+	domAny, dowAny bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q must have five fields: minute hour day-of-month month day-of-week", expr)
+	}
+	c := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	for _, f := range []struct {
+		set      *map[int]bool
+		spec     string
+		min, max int
+	}{
+		{&c.minute, fields[0], 0, 59},
+		{&c.hour, fields[1], 0, 23},
+		{&c.dom, fields[2], 1, 31},
+		{&c.month, fields[3], 1, 12},
+		{&c.dow, fields[4], 0, 7},
+	} {
+		if *f.set, err = parseCronField(f.spec, f.min, f.max); err != nil {
+			return nil, fmt.Errorf("schedule %q: %s", expr, err)
+		}
+	}
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	return c, nil
+}
+
+// parseCronField parses a comma separated list of *, n, a-b, each optionally followed by /step.
+func parseCronField(spec string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if !c.domAny && !c.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Offline is a station's current blackout.
+type Offline struct {
+	CallSign string    `json:"callSign"`
+	Until    time.Time `json:"until"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+func (o *Offline) String() string {
+	s := "expected offline until " + o.Until.Format("15:04 MST")
+	if o.Reason != "" {
+		s += " (" + o.Reason + ")"
+	}
+	return s
+}
+
+// offlineStations returns the stations in a blackout at now keyed by stream id. Blackouts that do
+// not compile are logged and ignored.
+func offlineStations(stations []*Station, now time.Time) map[string]*Offline {
+	offline := make(map[string]*Offline)
+	for _, st := range stations {
+		for _, b := range st.Blackouts {
+			cb, err := b.compile()
+			if err != nil {
+				log.Error("ignoring blackout for %s: %s", st.StreamID, err)
+				continue
+			}
+			if until, ok := cb.offlineAt(now); ok {
+				if o, seen := offline[st.StreamID]; !seen || until.After(o.Until) {
+					offline[st.StreamID] = &Offline{CallSign: st.CallSign, Until: until, Reason: b.Reason}
+				}
+			}
+		}
+	}
+	return offline
+}
+
+// offline returns the stations in the lineup expected to be off the air at now. Without a lineup, or
+// if it cannot be read, nothing is.
+func (s *server) offline(ctx context.Context, now time.Time) map[string]*Offline {
+	if s.lineup == nil {
+		return map[string]*Offline{}
+	}
+	stations, err := s.lineup.Stations(ctx)
+	if err != nil {
+		log.Error("could not read lineup for blackouts %s", err)
+		return map[string]*Offline{}
+	}
+	return offlineStations(s.catalog.withTimezones(stations), now)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+	c, err := parseCron("*/15 1-3,22 * * 1-5")
+	assert.Nil(t, err)
+	assert.Len(t, c.minute, 4)
+	assert.Equal(t, map[int]bool{1: true, 2: true, 3: true, 22: true}, c.hour)
+	assert.Len(t, c.dow, 5)
+
+	c, err = parseCron("0 0 1 * 7")
+	assert.Nil(t, err)
+	assert.True(t, c.dow[0], "7 is sunday")
+	// With both day fields restricted either may match.
+	assert.True(t, c.matches(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)))
+	assert.True(t, c.matches(time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, c.matches(time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC)))
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "a * * * *"} {
+		_, err := parseCron(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestBlackoutOfflineAt(t *testing.T) {
+	b, err := (&Blackout{Schedule: "30 23 * * *", Duration: "6h", Timezone: "America/Chicago"}).compile()
+	assert.Nil(t, err)
+	chicago, _ := time.LoadLocation("America/Chicago")
+
+	until, ok := b.offlineAt(time.Date(2026, 3, 4, 2, 0, 0, 0, chicago))
+	assert.True(t, ok, "the window crosses midnight")
+	assert.Equal(t, time.Date(2026, 3, 4, 5, 30, 0, 0, chicago), until)
+	_, ok = b.offlineAt(time.Date(2026, 3, 4, 5, 30, 0, 0, chicago))
+	assert.False(t, ok, "the window ends at the start of the minute")
+	_, ok = b.offlineAt(time.Date(2026, 3, 4, 23, 29, 0, 0, chicago))
+	assert.False(t, ok)
+	_, ok = b.offlineAt(time.Date(2026, 3, 5, 6, 0, 0, 0, time.UTC))
+	assert.True(t, ok, "times are read in the blackout's zone")
+
+	for _, bad := range []*Blackout{
+		{Schedule: "0 0 * * *", Duration: "30s"},
+		{Schedule: "0 0 * * *", Duration: "200h"},
+		{Schedule: "0 0 * * *", Duration: "1h", Timezone: "Mars/Olympus"},
+	} {
+		_, err := bad.compile()
+		assert.NotNil(t, err, bad.Duration+bad.Timezone)
+	}
+}
+
+// allDay is a blackout covering the whole of every day.
+var allDay = []*Blackout{{Schedule: "0 0 * * *", Duration: "24h", Reason: "sports blackout"}}
+
+func TestBlackoutSuppressesChecks(t *testing.T) {
+	s, cleanup := lineupServer(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	var rep LineupReport
+	assert.Nil(t, json.Unmarshal(get(s, "/api/lineup").Body.Bytes(), &rep))
+	assert.Len(t, rep.Problems, 4)
+
+	for _, id := range []string{"KHHH-1008", "WGGG-1007"} {
+		assert.Nil(t, s.lineup.Put(ctx, &Station{CallSign: id[:4], StreamID: id, Blackouts: allDay}))
+	}
+	rep = LineupReport{}
+	assert.Nil(t, json.Unmarshal(get(s, "/api/lineup").Body.Bytes(), &rep))
+	assert.Len(t, rep.Problems, 2, "missing KHHH is expected offline and WGGG is now in the lineup")
+	assert.Equal(t, "sports blackout", rep.Offline["KHHH-1008"].Reason)
+	assert.Contains(t, get(s, "/lineup").Body.String(), "expected offline until")
+
+	var crep ConsistencyReport
+	assert.Nil(t, json.Unmarshal(get(s, "/api/consistency").Body.Bytes(), &crep))
+	assert.Empty(t, crep.Inconsistencies)
+	if assert.Len(t, crep.Suppressed, 1) {
+		assert.Equal(t, "WGGG-1007", crep.Suppressed[0].StreamID)
+	}
+	var suite junitSuite
+	assert.Nil(t, xml.Unmarshal(get(s, "/api/consistency.xml").Body.Bytes(), &suite))
+	assert.Equal(t, 0, suite.Failures)
+	assert.Equal(t, 1, suite.Skipped)
+}
+
+func TestBlackoutShownOnStreamLists(t *testing.T) {
+	s, cleanup := lineupServer(t)
+	defer cleanup()
+	assert.NotContains(t, get(s, "/").Body.String(), "offline (scheduled)")
+
+	assert.Nil(t, s.lineup.Put(context.Background(), &Station{CallSign: "KAAA", StreamID: "KAAA-1001", Blackouts: allDay}))
+	for _, path := range []string{"/", "/adapters", "/transcoders"} {
+		assert.Contains(t, get(s, path).Body.String(), "KAAA offline (scheduled)", path)
+	}
+}
+
+func TestBlackoutSuppressesAlerts(t *testing.T) {
+	s, cleanup := lineupServer(t)
+	defer cleanup()
+	n := &recordingNotifier{}
+	s.alerts = &alerter{notifiers: []notifier{n}, offline: s.offline}
+
+	ctx := context.Background()
+	assert.Nil(t, s.lineup.Put(ctx, &Station{CallSign: "WGGG", StreamID: "WGGG-1007", Blackouts: allDay}))
+	s.reconcile(ctx)
+	assert.Empty(t, n.alerts, "blacked out streams do not alert")
+	assert.Nil(t, s.lineup.Put(ctx, &Station{CallSign: "WGGG", StreamID: "WGGG-1007"}))
+	get(s, "/api/consistency")
+	assert.Empty(t, n.alerts, "pages do not alert")
+	s.reconcile(ctx)
+	s.reconcile(ctx)
+	if assert.Len(t, n.alerts, 1, "inconsistencies alert once the blackout ends") {
+		assert.Equal(t, []string{"WGGG-1007"}, n.alerts[0].Streams)
+	}
+	assert.Nil(t, s.lineup.Put(ctx, &Station{CallSign: "WGGG", StreamID: "WGGG-1007", Blackouts: allDay}))
+	s.reconcile(ctx)
+	assert.Len(t, n.alerts, 1, "blacked out is not resolved")
+
+	assert.Nil(t, s.lineup.Put(context.Background(), &Station{StreamID: "KAAA-1001", Blackouts: allDay}))
+	now := time.Now()
+	s.alerts.send(context.Background(), &Alert{Time: now, Streams: []string{"KAAA-1001"}})
+	assert.Len(t, n.alerts, 1)
+	s.alerts.send(context.Background(), &Alert{Time: now, Streams: []string{"KAAA-1001", "KBBB-1002"}})
+	s.alerts.send(context.Background(), &Alert{Time: now, Subject: metricActiveStreams})
+	assert.Len(t, n.alerts, 3)
+}
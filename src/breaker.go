@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker stops calls to a backend after threshold consecutive failures. Once cooldown has passed a
+// single probe call is let through; its success closes the breaker and its failure reopens it.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	probing  bool
+	openedAt time.Time
+	lastErr  string
+}
+
+func newBreaker(name string, threshold int, cooldown time.Duration) *breaker {
+	return &breaker{name: name, threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// BreakerStatus is the state of one backend's breaker, as reported by /health.
+type BreakerStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"lastError,omitempty"`
+	OpenedAt  time.Time `json:"openedAt,omitempty"`
+}
+
+// do runs f unless the breaker is open. A nil breaker always runs f. If ctx, the caller's context, was
+// cancelled the outcome says nothing about the backend, so it is not recorded: a user closing a page
+// must not count against the backend for everyone else.
+func (b *breaker) do(ctx context.Context, f func() error) error {
+	if b == nil {
+		return f()
+	}
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := f()
+	if err != nil && ctx.Err() == context.Canceled {
+		b.release()
+		return err
+	}
+	b.record(err)
+	return err
+}
+
+// release ends a call without recording its outcome, so a half-open breaker can send another probe.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		wait := b.cooldown - b.now().Sub(b.openedAt)
+		if wait > 0 {
+			return fmt.Errorf("circuit open after %d failures, retry in %s", b.failures, wait.Round(time.Second))
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+	case breakerHalfOpen:
+		if b.probing {
+			return fmt.Errorf("circuit half-open, waiting on probe")
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.lastErr = err.Error()
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+func (b *breaker) status() *BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := &BreakerStatus{Name: b.name, State: b.state.String(), Failures: b.failures, LastError: b.lastErr}
+	if b.state != breakerClosed {
+		st.OpenedAt = b.openedAt
+	}
+	return st
+}
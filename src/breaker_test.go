@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	ctx := context.Background()
+	b := newBreaker("adapter", 2, time.Minute)
+	b.now = func() time.Time { return now }
+	fail := func() error { return errors.New("es down") }
+	calls := 0
+	ok := func() error { calls++; return nil }
+
+	assert.NotNil(t, b.do(ctx, fail))
+	assert.Equal(t, "closed", b.status().State)
+	assert.NotNil(t, b.do(ctx, fail))
+	assert.Equal(t, "open", b.status().State)
+
+	assert.Contains(t, b.do(ctx, ok).Error(), "circuit open")
+	assert.Equal(t, 0, calls)
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, b.allow())
+	assert.Equal(t, "half-open", b.status().State)
+	assert.Contains(t, b.do(ctx, ok).Error(), "half-open")
+	b.record(errors.New("still down"))
+	assert.Equal(t, "open", b.status().State)
+	assert.Equal(t, "still down", b.status().LastError)
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, b.do(ctx, ok))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, &BreakerStatus{Name: "adapter", State: "closed", LastError: "still down"}, b.status())
+
+	var none *breaker
+	assert.Nil(t, none.do(ctx, ok))
+}
+
+func TestBreakerIgnoresCancelledCalls(t *testing.T) {
+	now := time.Now()
+	b := newBreaker("catcher", 1, time.Minute)
+	b.now = func() time.Time { return now }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	gone := func() error { return context.Canceled }
+
+	assert.NotNil(t, b.do(ctx, gone))
+	assert.Equal(t, &BreakerStatus{Name: "catcher", State: "closed"}, b.status())
+
+	assert.NotNil(t, b.do(context.Background(), func() error { return errors.New("redis down") }))
+	now = now.Add(time.Minute)
+	assert.NotNil(t, b.do(ctx, gone))
+	assert.Equal(t, "half-open", b.status().State)
+	assert.Nil(t, b.do(context.Background(), func() error { return nil }), "a cancelled probe lets the next call probe")
+	assert.Equal(t, "closed", b.status().State)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Field prefixes in the capacity hash, i.e. HSET <CapacityHash> type:1080p 6 or host:catcher03 4.
+const (
+	capacityTypeField = "type:"
+	capacityHostField = "host:"
+)
+
+// capacityLimits is how many streams each host can hold. A host override, keyed by host name, short
+// host name or ip, wins over a catcher's host type limit, which wins over the global default. Hosts in
+// a maintenance window that excludes them from capacity hold none.
+type capacityLimits struct {
+	catcher int
+	adapter int
+	types   map[string]int
+	hosts   map[string]int
+	// maint is the maintenance windows in effect
+	maint maintenanceSet
+}
+
+// maintenance describes the maintenance window a host is in, or is empty.
+func (l *capacityLimits) maintenance(names ...string) string {
+	if m := l.maint.find(names...); m != nil {
+		return m.String()
+	}
+	return ""
+}
+
+func (l *capacityLimits) excluded(names ...string) bool {
+	m := l.maint.find(names...)
+	return m != nil && m.ExcludeCapacity
+}
+
+func (l *capacityLimits) host(keys ...string) (int, bool) {
+	for _, k := range keys {
+		if k == "" {
+			continue
+		}
+		if n, ok := l.hosts[k]; ok {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func (l *capacityLimits) catcherCapacity(c *Catcher) int {
+	if l.excluded(c.Hostname, c.IP) {
+		return 0
+	}
+	if n, ok := l.host(c.Hostname, shortHost(c.Hostname), c.IP); ok {
+		return n
+	}
+	if n, ok := l.types[c.Type]; ok && c.Type != "" {
+		return n
+	}
+	return l.catcher
+}
+
+func (l *capacityLimits) adapterCapacity(a *Adapter) int {
+	if l.excluded(a.IP) {
+		return 0
+	}
+	if n, ok := l.host(a.IP); ok {
+		return n
+	}
+	return l.adapter
+}
+
+func (l *capacityLimits) catcherSlots(catchers []*Catcher) int {
+	slots := 0
+	for _, c := range catchers {
+		slots += l.catcherCapacity(c)
+	}
+	return slots
+}
+
+func (l *capacityLimits) adapterSlots(adapters []*Adapter) int {
+	slots := 0
+	for _, a := range adapters {
+		slots += l.adapterCapacity(a)
+	}
+	return slots
+}
+
+// limits returns the configured capacity limits with any overrides from the capacity hash applied.
+// If the hash cannot be read the configured limits are used alone. Hosts whose current maintenance
+// window asks for it are excluded.
+func (s *server) limits(ctx context.Context) *capacityLimits {
+	l := &capacityLimits{catcher: s.maxCatcher, adapter: s.maxAdapter, types: make(map[string]int), hosts: make(map[string]int)}
+	for k, n := range s.typeCapacity {
+		l.types[k] = n
+	}
+	for k, n := range s.hostCapacity {
+		l.hosts[k] = n
+	}
+	l.maint = s.maintenance(ctx, time.Now())
+	if s.capacityDb == nil {
+		return l
+	}
+	fields, err := s.capacityDb.overrides(ctx)
+	if err != nil {
+		log.Warning("using configured capacity, could not read %s: %s", s.capacityDb.key, err)
+		return l
+	}
+	for field, n := range fields {
+		switch {
+		case strings.HasPrefix(field, capacityTypeField):
+			l.types[strings.TrimPrefix(field, capacityTypeField)] = n
+		case strings.HasPrefix(field, capacityHostField):
+			l.hosts[strings.TrimPrefix(field, capacityHostField)] = n
+		}
+	}
+	return l
+}
+
+// capacityDb reads capacity overrides from a redis hash so they can be changed without a redeploy.
+type capacityDb struct {
+	redisServer
+	key string
+}
+
+func newCapacityDb(rs redisServer, key string) *capacityDb {
+	return &capacityDb{redisServer: rs, key: key}
+}
+
+// overrides returns the hash's fields. Fields whose values are not whole numbers are skipped.
+func (db *capacityDb) overrides(ctx context.Context) (map[string]int, error) {
+	vals, err := redis.StringMap(db.do(ctx, "HGETALL", db.key))
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]int)
+	for field, val := range vals {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			log.Error("ignoring capacity %s=%q in %s", field, val, db.key)
+			continue
+		}
+		fields[field] = n
+	}
+	return fields, nil
+}
+
+// intMap converts a config section of numbers, as read by jsconfig, to ints.
+func intMap(m map[string]interface{}) map[string]int {
+	out := make(map[string]int)
+	for k, v := range m {
+		if n, ok := v.(float64); ok {
+			out[k] = int(n)
+		}
+	}
+	return out
+}
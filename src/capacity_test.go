@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapacityLimits(t *testing.T) {
+	l := &capacityLimits{
+		catcher: 9,
+		adapter: 8,
+		types:   map[string]int{"720p": 12, "1080p": 6},
+		hosts:   map[string]int{"catcher02": 3, "10.0.0.3": 2, "10.0.1.2": 4},
+	}
+	catchers := []*Catcher{
+		{IP: "10.0.0.1", Hostname: "catcher01.syncbak.corp", Type: "720p"},
+		{IP: "10.0.0.2", Hostname: "catcher02.syncbak.corp", Type: "720p"},
+		{IP: "10.0.0.3", Hostname: "catcher03.syncbak.corp", Type: "1080p"},
+		{IP: "10.0.0.4", Hostname: "catcher04.syncbak.corp", Type: "1080p"},
+		{IP: "10.0.0.5", Type: "480p"},
+	}
+	var got []int
+	for _, c := range catchers {
+		got = append(got, l.catcherCapacity(c))
+	}
+	assert.Equal(t, []int{12, 3, 2, 6, 9}, got)
+	assert.Equal(t, 32, l.catcherSlots(catchers))
+	assert.Equal(t, 12, l.adapterSlots([]*Adapter{{IP: "10.0.1.1"}, {IP: "10.0.1.2"}}))
+}
+
+func TestSlotsUseCapacity(t *testing.T) {
+	s := testServer(t)
+	s.typeCapacity = map[string]int{"1080p": 5}
+	s.hostCapacity = map[string]int{"catcher03": 4, "10.10.2.12": 6}
+	assert.Equal(t, "18", get(s, "/catchers/slots").Body.String())
+	assert.Equal(t, "15", get(s, "/adapters/slots").Body.String())
+
+	// An unreachable capacity hash leaves the configured limits in place.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "%s", err)
+	addr := l.Addr().String()
+	l.Close()
+	s.capacityDb = newCapacityDb(redisServer{addr: addr, timeout: time.Second}, "capacity")
+	assert.Equal(t, 4, s.limits(context.Background()).hosts["catcher03"])
+	assert.Equal(t, "18", get(s, "/catchers/slots").Body.String())
+}
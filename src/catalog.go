@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// StationInfo is what the station catalog knows about a call sign.
+type StationInfo struct {
+	CallSign string `json:"callSign"`
+	Market   string `json:"market,omitempty"`
+	DMARank  int    `json:"dmaRank,omitempty"`
+	Network  string `json:"network,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	// Timezone is the station's IANA zone, used for its blackouts when they name none.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// callSign returns the call sign part of a source stream id such as KAAA-1001.
+func callSign(streamID string) string {
+	return strings.SplitN(streamID, "-", 2)[0]
+}
+
+// catalog is the station catalog, read from a csv or json file and replaced by imports.
+type catalog struct {
+	path     string
+	mu       sync.RWMutex
+	stations map[string]*StationInfo
+}
+
+func loadCatalog(path string) (*catalog, error) {
+	c := &catalog{path: path, stations: make(map[string]*StationInfo)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	infos, err := parseCatalog(f, isCSV(path))
+	if err != nil {
+		return nil, fmt.Errorf("could not read station catalog %s: %s", path, err)
+	}
+	c.set(infos)
+	return c, nil
+}
+
+func isCSV(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".csv")
+}
+
+// parseCatalog reads a json list of stations, or csv with a header row naming the columns.
+func parseCatalog(r io.Reader, asCSV bool) ([]*StationInfo, error) {
+	if !asCSV {
+		infos := []*StationInfo{}
+		if err := json.NewDecoder(r).Decode(&infos); err != nil {
+			return nil, err
+		}
+		for i, info := range infos {
+			if info.CallSign == "" {
+				return nil, fmt.Errorf("station %d has no callSign", i+1)
+			}
+		}
+		return infos, nil
+	}
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no header row")
+	}
+	cols := make(map[string]int)
+	for i, name := range rows[0] {
+		cols[strings.ToLower(strings.NewReplacer("_", "", " ", "").Replace(strings.TrimSpace(name)))] = i
+	}
+	if _, ok := cols["callsign"]; !ok {
+		return nil, fmt.Errorf("no call_sign column")
+	}
+	field := func(row []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	var infos []*StationInfo
+	for n, row := range rows[1:] {
+		info := &StationInfo{CallSign: field(row, "callsign"), Market: field(row, "market"), Network: field(row, "network"),
+			Owner: field(row, "owner"), Timezone: field(row, "timezone")}
+		if info.CallSign == "" {
+			return nil, fmt.Errorf("row %d has no call sign", n+2)
+		}
+		if rank := field(row, "dmarank"); rank != "" {
+			if info.DMARank, err = strconv.Atoi(rank); err != nil {
+				return nil, fmt.Errorf("row %d: bad dma rank %q", n+2, rank)
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (c *catalog) set(infos []*StationInfo) {
+	stations := make(map[string]*StationInfo)
+	for _, info := range infos {
+		stations[info.CallSign] = info
+	}
+	c.mu.Lock()
+	c.stations = stations
+	c.mu.Unlock()
+}
+
+// lookup returns the catalog entry for a stream id or call sign, or nil.
+func (c *catalog) lookup(id string) *StationInfo {
+	if c == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stations[callSign(id)]
+}
+
+// all returns every entry sorted by call sign.
+func (c *catalog) all() []*StationInfo {
+	infos := []*StationInfo{}
+	if c == nil {
+		return infos
+	}
+	c.mu.RLock()
+	for _, info := range c.stations {
+		infos = append(infos, info)
+	}
+	c.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CallSign < infos[j].CallSign
+	})
+	return infos
+}
+
+// replace swaps in infos and saves them to the catalog file in its own format.
+func (c *catalog) replace(infos []*StationInfo) error {
+	var buf bytes.Buffer
+	if isCSV(c.path) {
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"call_sign", "market", "dma_rank", "network", "owner", "timezone"})
+		for _, info := range infos {
+			rank := ""
+			if info.DMARank > 0 {
+				rank = strconv.Itoa(info.DMARank)
+			}
+			w.Write([]string{info.CallSign, info.Market, rank, info.Network, info.Owner, info.Timezone})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	} else {
+		b, err := json.MarshalIndent(infos, "", "    ")
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.set(infos)
+	return nil
+}
+
+// withTimezones returns stations with their catalog timezone filled into blackouts that name none.
+// Stations that need no change are returned as they are.
+func (c *catalog) withTimezones(stations []*Station) []*Station {
+	if c == nil {
+		return stations
+	}
+	out := make([]*Station, len(stations))
+	for i, st := range stations {
+		out[i] = st
+		info := c.lookup(st.StreamID)
+		if info == nil || info.Timezone == "" {
+			continue
+		}
+		cp := *st
+		cp.Blackouts = make([]*Blackout, len(st.Blackouts))
+		for j, b := range st.Blackouts {
+			bc := *b
+			if bc.Timezone == "" {
+				bc.Timezone = info.Timezone
+			}
+			cp.Blackouts[j] = &bc
+		}
+		out[i] = &cp
+	}
+	return out
+}
+
+// enrich joins catalog entries onto every stream in hd. Hosts and streams are copied rather than
+// annotated in place since sources may hand out the same values to concurrent requests.
+func (c *catalog) enrich(hd *HomeDisplay) {
+	if c == nil {
+		return
+	}
+	annotate := func(streams []*SourceStream) []*SourceStream {
+		out := make([]*SourceStream, len(streams))
+		for i, s := range streams {
+			cp := *s
+			cp.Station = c.lookup(s.ID)
+			out[i] = &cp
+		}
+		return out
+	}
+	catchers := make([]*Catcher, len(hd.Catchers))
+	for i, h := range hd.Catchers {
+		cp := *h
+		cp.Streams = annotate(h.Streams)
+		catchers[i] = &cp
+	}
+	adapters := make([]*Adapter, len(hd.Adapters))
+	for i, a := range hd.Adapters {
+		cp := *a
+		cp.Streams = annotate(a.Streams)
+		adapters[i] = &cp
+	}
+	transcoders := make([]*Transcoder, len(hd.Transcoders))
+	for i, t := range hd.Transcoders {
+		cp := *t
+		cp.Streams = annotate(t.Streams)
+		transcoders[i] = &cp
+	}
+	hd.Catchers, hd.Adapters, hd.Transcoders = catchers, adapters, transcoders
+}
+
+// stationFilter selects streams by their catalog entry. Empty fields match everything.
+type stationFilter struct {
+	market  string
+	network string
+}
+
+func (f stationFilter) empty() bool {
+	return f.market == "" && f.network == ""
+}
+
+func (f stationFilter) match(info *StationInfo) bool {
+	if f.empty() {
+		return true
+	}
+	return info != nil && (f.market == "" || strings.EqualFold(info.Market, f.market)) &&
+		(f.network == "" || strings.EqualFold(info.Network, f.network))
+}
+
+// apply drops the streams in hd that f does not match, and the catchers and adapters left without
+// any. hd must already be enriched so its streams are its own to change.
+func (f stationFilter) apply(hd *HomeDisplay) {
+	if f.empty() {
+		return
+	}
+	keep := func(streams []*SourceStream) []*SourceStream {
+		var out []*SourceStream
+		for _, s := range streams {
+			if f.match(s.Station) {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	var catchers []*Catcher
+	for _, c := range hd.Catchers {
+		if c.Streams = keep(c.Streams); len(c.Streams) > 0 {
+			catchers = append(catchers, c)
+		}
+	}
+	var adapters []*Adapter
+	for _, a := range hd.Adapters {
+		if a.Streams = keep(a.Streams); len(a.Streams) > 0 {
+			adapters = append(adapters, a)
+		}
+	}
+	hd.Catchers, hd.Adapters = catchers, adapters
+	hd.SplitStreams = splitStreams(adapters)
+}
+
+// StationGroup summarizes the catalog stations sharing a market or network.
+type StationGroup struct {
+	Name       string   `json:"name"`
+	Stations   int      `json:"stations"`
+	OnCatchers int      `json:"onCatchers"`
+	OnAdapters int      `json:"onAdapters"`
+	Missing    []string `json:"missing"`
+}
+
+// groupStations groups the catalog by market or network and counts the stations seen on catchers
+// and adapters. Missing lists the call signs seen on neither.
+func groupStations(infos []*StationInfo, by string, hd *HomeDisplay) []*StationGroup {
+	caught, adapted := make(map[string]bool), make(map[string]bool)
+	for _, c := range hd.Catchers {
+		for _, s := range c.Streams {
+			caught[callSign(s.ID)] = true
+		}
+	}
+	for _, a := range hd.Adapters {
+		for _, s := range a.Streams {
+			adapted[callSign(s.ID)] = true
+		}
+	}
+	groups := make(map[string]*StationGroup)
+	for _, info := range infos {
+		name := info.Network
+		if by == "market" {
+			name = info.Market
+		}
+		if name == "" {
+			name = "unknown"
+		}
+		g, ok := groups[name]
+		if !ok {
+			g = &StationGroup{Name: name, Missing: []string{}}
+			groups[name] = g
+		}
+		g.Stations++
+		if caught[info.CallSign] {
+			g.OnCatchers++
+		}
+		if adapted[info.CallSign] {
+			g.OnAdapters++
+		}
+		if !caught[info.CallSign] && !adapted[info.CallSign] {
+			g.Missing = append(g.Missing, info.CallSign)
+		}
+	}
+	out := []*StationGroup{}
+	for _, g := range groups {
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// catalogValues returns the distinct markets and networks in the catalog for the filter pickers.
+func catalogValues(infos []*StationInfo) (markets, networks []string) {
+	for _, info := range infos {
+		markets = append(markets, info.Market)
+		networks = append(networks, info.Network)
+	}
+	return uniq(markets), uniq(networks)
+}
+
+func (s *server) CatalogJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.catalog == nil {
+		http.Error(w, "no station catalog configured", http.StatusNotFound)
+		return
+	}
+	serveJson(w, s.catalog.all())
+}
+
+// ImportCatalog replaces the catalog with the csv (Content-Type text/csv) or json list in the body.
+func (s *server) ImportCatalog(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.catalog == nil {
+		http.Error(w, "no station catalog configured", http.StatusNotFound)
+		return
+	}
+	infos, err := parseCatalog(r.Body, strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv"))
+	if err != nil {
+		http.Error(w, "could not read catalog: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.catalog.replace(infos); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Info("imported %d stations into %s", len(infos), s.catalog.path)
+	serveJson(w, s.catalog.all())
+}
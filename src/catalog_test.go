@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func catalogServer(t *testing.T) (*server, func()) {
+	dir, err := ioutil.TempDir("", "catalog")
+	assert.Nil(t, err)
+	b, err := ioutil.ReadFile("fixtures/catalog.csv")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "catalog.csv")
+	assert.Nil(t, ioutil.WriteFile(path, b, 0644))
+	s := testServer(t)
+	s.catalog, err = loadCatalog(path)
+	assert.Nil(t, err)
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestParseCatalog(t *testing.T) {
+	infos, err := parseCatalog(strings.NewReader("Call Sign,DMA Rank,Network\nKAAA,5,NBC\nKBBB,,CBS\n"), true)
+	assert.Nil(t, err)
+	assert.Equal(t, []*StationInfo{{CallSign: "KAAA", DMARank: 5, Network: "NBC"}, {CallSign: "KBBB", Network: "CBS"}}, infos)
+
+	infos, err = parseCatalog(strings.NewReader(`[{"callSign": "KAAA", "market": "Dallas-Ft. Worth"}]`), false)
+	assert.Nil(t, err)
+	assert.Equal(t, "Dallas-Ft. Worth", infos[0].Market)
+
+	for _, bad := range []string{"market\nDallas\n", "call_sign,dma_rank\nKAAA,fifth\n", "call_sign,market\n,Dallas\n"} {
+		_, err := parseCatalog(strings.NewReader(bad), true)
+		assert.NotNil(t, err, bad)
+	}
+	_, err = parseCatalog(strings.NewReader(`[{"market": "Dallas"}]`), false)
+	assert.NotNil(t, err)
+}
+
+func TestCatalogJoin(t *testing.T) {
+	s, cleanup := catalogServer(t)
+	defer cleanup()
+
+	var catchers []*Catcher
+	assert.Nil(t, json.Unmarshal(get(s, "/api/catchers").Body.Bytes(), &catchers))
+	assert.Equal(t, "KAAA-1001", catchers[0].Streams[0].ID)
+	assert.Equal(t, &StationInfo{CallSign: "KAAA", Market: "Dallas-Ft. Worth", DMARank: 5, Network: "NBC",
+		Owner: "Lone Star Media", Timezone: "America/Chicago"}, catchers[0].Streams[0].Station)
+
+	// the source's own values are left alone
+	cs, err := s.catchers.Catchers(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, cs[0].Streams[0].Station)
+
+	assert.Contains(t, get(s, "/transcoders").Body.String(), "Atlanta")
+}
+
+func TestCatalogFilterAndGroup(t *testing.T) {
+	s, cleanup := catalogServer(t)
+	defer cleanup()
+
+	body := get(s, "/?market=Atlanta").Body.String()
+	assert.Contains(t, body, "WCCC-1003")
+	assert.Contains(t, body, "WGGG-1007")
+	assert.NotContains(t, body, "KAAA-1001")
+	assert.NotContains(t, body, "catcher02")
+
+	body = get(s, "/adapters?network=cbs").Body.String()
+	assert.Contains(t, body, "KFFF-1006")
+	assert.NotContains(t, body, "WCCC-1003")
+
+	hd, err := s.fetch(httptest.NewRequest("GET", "/", nil), partCatchers, partAdapters)
+	assert.Nil(t, err)
+	groups := groupStations(s.catalog.all(), "market", hd)
+	assert.Len(t, groups, 4)
+	assert.Equal(t, &StationGroup{Name: "Atlanta", Stations: 3, OnCatchers: 3, OnAdapters: 2, Missing: []string{}}, groups[0])
+	assert.Equal(t, &StationGroup{Name: "Phoenix", Stations: 1, Missing: []string{"KHHH"}}, groups[3])
+
+	body = get(s, "/?group=network&network=ABC").Body.String()
+	assert.Contains(t, body, "Stations by network")
+	assert.Contains(t, body, "KHHH")
+}
+
+func TestCatalogImport(t *testing.T) {
+	s, cleanup := catalogServer(t)
+	defer cleanup()
+
+	w := send(s, "POST", "/api/catalog", `[{"callSign": "KAAA", "market": "Houston", "dmaRank": 8}]`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var infos []*StationInfo
+	assert.Nil(t, json.Unmarshal(get(s, "/api/catalog").Body.Bytes(), &infos))
+	assert.Equal(t, []*StationInfo{{CallSign: "KAAA", Market: "Houston", DMARank: 8}}, infos)
+
+	reloaded, err := loadCatalog(s.catalog.path)
+	assert.Nil(t, err)
+	assert.Equal(t, infos, reloaded.all())
+
+	assert.Equal(t, http.StatusBadRequest, send(s, "POST", "/api/catalog", `[{"market": "Houston"}]`).Code)
+	assert.Equal(t, http.StatusNotFound, send(testServer(t), "POST", "/api/catalog", `[]`).Code)
+}
+
+func TestCatalogTimezones(t *testing.T) {
+	s, cleanup := catalogServer(t)
+	defer cleanup()
+
+	stations := []*Station{
+		{StreamID: "KAAA-1001", Blackouts: []*Blackout{{Schedule: "0 2 * * *", Duration: "1h"}, {Schedule: "0 3 * * *", Duration: "1h", Timezone: "UTC"}}},
+		{StreamID: "XNONE-1"},
+	}
+	got := s.catalog.withTimezones(stations)
+	assert.Equal(t, "America/Chicago", got[0].Blackouts[0].Timezone)
+	assert.Equal(t, "UTC", got[0].Blackouts[1].Timezone)
+	assert.Equal(t, "", stations[0].Blackouts[0].Timezone)
+	assert.True(t, got[1] == stations[1])
+	assert.True(t, (*catalog)(nil).withTimezones(stations)[0] == stations[0])
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"sort"
-	"time"
 
 	"github.com/Syncbak-Git/elasticgo"
 )
@@ -12,34 +12,89 @@ type Assignment struct {
 	Host  string `json:"host"`
 }
 
-func adapterAssignments() (map[string][]string, error) {
-	hosts := make(map[string][]string)
+// SplitStream is a source stream logged by more than one adapter in the same window.
+type SplitStream struct {
+	ID  string   `json:"id"`
+	IPs []string `json:"ips"`
+}
 
-	f, err := elasticgo.NewFinderForCluster("qa", time.Now().Add(-10*time.Minute), time.Now())
-	check(err)
-	f.Client.MaxResults = 2000
-	res, err := f.Name("cdnadapter").Find()
-	check(err)
+func adapterAssignments(ctx context.Context, cluster string, w window) ([]*Adapter, error) {
+	entries, err := findAll(ctx, finderFor(cluster, "cdnadapter"), w.From, w.To)
+	if err != nil {
+		return nil, err
+	}
+	return adaptersFromEntries(entries), nil
+}
 
-	sort.Slice(res.Entries, func(i, j int) bool {
-		return res.Entries[i].Timestamp.After(res.Entries[j].Timestamp)
+// adaptersFromEntries assigns each source stream to the adapter that logged it most recently. Other
+// adapters that logged the same stream are recorded in AlsoOn.
+func adaptersFromEntries(entries []elasticgo.Entry) []*Adapter {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Timestamp.After(entries[j].Timestamp)
 	})
 	em := make(map[string]elasticgo.Entry)
-	for _, b := range res.Entries {
-		_, ok := em[b.Fields.SourceStreamID]
+	others := make(map[string][]string)
+	for _, b := range entries {
+		latest, ok := em[b.Fields.SourceStreamID]
 		if !ok {
 			em[b.Fields.SourceStreamID] = b
+			continue
+		}
+		if b.Fields.IP != latest.Fields.IP && !contains(others[b.Fields.SourceStreamID], b.Fields.IP) {
+			others[b.Fields.SourceStreamID] = append(others[b.Fields.SourceStreamID], b.Fields.IP)
 		}
 	}
 
+	hosts := make(map[string]*Adapter)
 	for ssid, entry := range em {
-		queues, ok := hosts[entry.Fields.IP]
+		a, ok := hosts[entry.Fields.IP]
 		if !ok {
-			hosts[entry.Fields.IP] = []string{ssid}
-		} else {
-			queues = append(queues, ssid)
-			hosts[entry.Fields.IP] = queues
+			a = &Adapter{IP: entry.Fields.IP}
+			hosts[entry.Fields.IP] = a
+		}
+		alsoOn := others[ssid]
+		sort.Strings(alsoOn)
+		a.Streams = append(a.Streams, &SourceStream{ID: ssid, LastSeen: entry.Timestamp, AlsoOn: alsoOn})
+		if entry.Timestamp.After(a.LastSeen) {
+			a.LastSeen = entry.Timestamp
+		}
+	}
+
+	adapters := make([]*Adapter, 0, len(hosts))
+	for _, a := range hosts {
+		sortStreams(a.Streams)
+		adapters = append(adapters, a)
+	}
+	sort.Slice(adapters, func(i, j int) bool {
+		return adapters[i].IP < adapters[j].IP
+	})
+	return adapters
+}
+
+// splitStreams lists the streams seen on more than one adapter ip, a sign of a split brain.
+func splitStreams(adapters []*Adapter) []*SplitStream {
+	split := []*SplitStream{}
+	for _, a := range adapters {
+		for _, s := range a.Streams {
+			if len(s.AlsoOn) == 0 {
+				continue
+			}
+			ips := append([]string{a.IP}, s.AlsoOn...)
+			sort.Strings(ips)
+			split = append(split, &SplitStream{ID: s.ID, IPs: ips})
+		}
+	}
+	sort.Slice(split, func(i, j int) bool {
+		return split[i].ID < split[j].ID
+	})
+	return split
+}
+
+func contains(vals []string, v string) bool {
+	for _, s := range vals {
+		if s == v {
+			return true
 		}
 	}
-	return hosts, nil
+	return false
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Syncbak-Git/elasticgo"
+	"github.com/stretchr/testify/assert"
+)
+
+func entry(ssid, ip string, at time.Time) elasticgo.Entry {
+	e := elasticgo.Entry{Timestamp: at}
+	e.Fields.SourceStreamID = ssid
+	e.Fields.IP = ip
+	return e
+}
+
+func TestFindAllSplitsFullWindows(t *testing.T) {
+	start := time.Date(2019, 11, 22, 16, 0, 0, 0, time.UTC)
+	end := start.Add(10 * time.Minute)
+	// one entry per 100ms, 6000 in all
+	var logged []elasticgo.Entry
+	for at := start; at.Before(end); at = at.Add(100 * time.Millisecond) {
+		logged = append(logged, entry(fmt.Sprintf("S%d", len(logged)), "10.0.0.1", at))
+	}
+	calls := 0
+	find := func(ctx context.Context, from, to time.Time, max int) ([]elasticgo.Entry, error) {
+		calls++
+		var res []elasticgo.Entry
+		for _, e := range logged {
+			if !e.Timestamp.Before(from) && e.Timestamp.Before(to) && len(res) < max {
+				res = append(res, e)
+			}
+		}
+		return res, nil
+	}
+
+	entries, err := findAll(context.Background(), find, start, end)
+	assert.Nil(t, err, "%s", err)
+	assert.Len(t, entries, len(logged))
+	assert.True(t, calls > 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	_, err = findAll(ctx, find, start, end)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, calls)
+}
+
+func TestAdaptersFromEntries(t *testing.T) {
+	now := time.Now()
+	adapters := adaptersFromEntries([]elasticgo.Entry{
+		entry("KAAA-1001", "10.0.0.1", now.Add(-time.Minute)),
+		entry("KAAA-1001", "10.0.0.2", now),
+		entry("KAAA-1001", "10.0.0.3", now.Add(-2*time.Minute)),
+		entry("KBBB-1002", "10.0.0.1", now),
+	})
+	assert.Len(t, adapters, 2)
+	assert.Equal(t, "10.0.0.2", adapters[1].IP)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, adapters[1].Streams[0].AlsoOn)
+	assert.Empty(t, adapters[0].Streams[0].AlsoOn)
+
+	split := splitStreams(adapters)
+	assert.Len(t, split, 1)
+	assert.Equal(t, &SplitStream{ID: "KAAA-1001", IPs: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}, split[0])
+}
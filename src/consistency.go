@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Inconsistency kinds, named for the stage the stream is missing from.
+const (
+	notAdapted    = "caught but not adapted"
+	notCaught     = "adapted but not caught"
+	notTranscoded = "not transcoded"
+)
+
+// Inconsistency is a source stream missing from a stage of the pipeline.
+type Inconsistency struct {
+	StreamID  string       `json:"streamId"`
+	Kind      string       `json:"kind"`
+	Catcher   string       `json:"catcher,omitempty"`
+	Adapter   string       `json:"adapter,omitempty"`
+	FirstSeen time.Time    `json:"firstSeen"`
+	Station   *StationInfo `json:"station,omitempty"`
+	// Ignored says why a suppressed inconsistency is expected.
+	Ignored string `json:"ignored,omitempty"`
+}
+
+// ConsistencyReport compares the source streams held by catchers, seen by CDN adapters and processed
+// by transcoders. The redirect hash only carries per host counts so it takes no part. Checks that
+// need a stage whose data is unavailable are skipped and the stage is listed in Degraded.
+type ConsistencyReport struct {
+	GeneratedAt     time.Time        `json:"generatedAt"`
+	Window          window           `json:"window"`
+	Caught          int              `json:"caught"`
+	Adapted         int              `json:"adapted"`
+	Transcoded      int              `json:"transcoded"`
+	Inconsistencies []*Inconsistency `json:"inconsistencies"`
+	// Suppressed are inconsistencies of stations expected to be off the air.
+	Suppressed []*Inconsistency `json:"suppressed"`
+	Degraded   []*Degradation   `json:"degraded"`
+}
+
+// suppress moves the inconsistencies of offline stations, and of streams on a catcher or adapter in
+// maintenance, to Suppressed.
+func (rep *ConsistencyReport) suppress(offline map[string]*Offline, maint maintenanceSet) {
+	kept := []*Inconsistency{}
+	for _, inc := range rep.Inconsistencies {
+		if o := offline[inc.StreamID]; o != nil {
+			inc.Ignored = o.String()
+		} else if m := maint.find(inc.Catcher, inc.Adapter); m != nil {
+			inc.Ignored = m.Host + " " + m.String()
+		} else {
+			kept = append(kept, inc)
+			continue
+		}
+		rep.Suppressed = append(rep.Suppressed, inc)
+	}
+	rep.Inconsistencies = kept
+}
+
+// checkConsistency builds a report from one fetch. FirstSeen is left for the reconciler to fill in.
+func checkConsistency(hd *HomeDisplay, now time.Time) *ConsistencyReport {
+	rep := &ConsistencyReport{GeneratedAt: now, Window: hd.Window, Inconsistencies: []*Inconsistency{}, Suppressed: []*Inconsistency{},
+		Degraded: hd.Degraded}
+	missing := make(map[string]bool)
+	for _, d := range hd.Degraded {
+		missing[d.Source] = true
+	}
+
+	caught := make(map[string]string)
+	for _, c := range hd.Catchers {
+		for _, s := range c.Streams {
+			caught[s.ID] = c.IP
+		}
+	}
+	adapted := make(map[string]string)
+	for _, a := range hd.Adapters {
+		for _, s := range a.Streams {
+			adapted[s.ID] = a.IP
+		}
+	}
+	transcoded := make(map[string]bool)
+	for _, t := range hd.Transcoders {
+		for _, s := range t.Streams {
+			transcoded[s.ID] = true
+		}
+	}
+	rep.Caught, rep.Adapted, rep.Transcoded = len(caught), len(adapted), len(transcoded)
+
+	haveCatchers := !missing[partNames[partCatchers]]
+	haveAdapters := !missing[partNames[partAdapters]]
+	haveTranscoders := !missing[partNames[partTranscoders]]
+	if haveCatchers && haveAdapters {
+		for id, ip := range caught {
+			if _, ok := adapted[id]; !ok {
+				rep.Inconsistencies = append(rep.Inconsistencies, &Inconsistency{StreamID: id, Kind: notAdapted, Catcher: ip})
+			}
+		}
+		for id, ip := range adapted {
+			if _, ok := caught[id]; !ok {
+				rep.Inconsistencies = append(rep.Inconsistencies, &Inconsistency{StreamID: id, Kind: notCaught, Adapter: ip})
+			}
+		}
+	}
+	if haveAdapters && haveTranscoders {
+		for id, ip := range adapted {
+			if !transcoded[id] {
+				rep.Inconsistencies = append(rep.Inconsistencies, &Inconsistency{StreamID: id, Kind: notTranscoded, Catcher: caught[id], Adapter: ip})
+			}
+		}
+	}
+	sort.Slice(rep.Inconsistencies, func(i, j int) bool {
+		a, b := rep.Inconsistencies[i], rep.Inconsistencies[j]
+		if a.StreamID == b.StreamID {
+			return a.Kind < b.Kind
+		}
+		return a.StreamID < b.StreamID
+	})
+	return rep
+}
+
+// reconciler remembers each inconsistency and when it was first reported, for as long as it persists.
+type reconciler struct {
+	mu    sync.Mutex
+	known map[string]*Inconsistency
+	last  *ConsistencyReport
+}
+
+func newReconciler() *reconciler {
+	return &reconciler{known: make(map[string]*Inconsistency)}
+}
+
+func (inc *Inconsistency) key() string {
+	return inc.Kind + " " + inc.StreamID
+}
+
+// record stamps rep with first seen times and returns the inconsistencies seen for the first time and
+// the ones that have cleared. Checks that were skipped for a missing stage, and known inconsistencies
+// that are now suppressed, keep their times and are neither new nor cleared, so a brief outage or a
+// maintenance window does not reset them.
+func (rc *reconciler) record(rep *ConsistencyReport) (fresh, resolved []*Inconsistency) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	seen := make(map[string]*Inconsistency)
+	for _, inc := range rep.Inconsistencies {
+		inc.FirstSeen = rep.GeneratedAt
+		if prev, ok := rc.known[inc.key()]; ok {
+			inc.FirstSeen = prev.FirstSeen
+		} else {
+			fresh = append(fresh, inc)
+		}
+		seen[inc.key()] = inc
+	}
+	for _, inc := range rep.Suppressed {
+		inc.FirstSeen = rep.GeneratedAt
+		if prev, ok := rc.known[inc.key()]; ok {
+			inc.FirstSeen = prev.FirstSeen
+			seen[inc.key()] = prev
+		}
+	}
+	for key, prev := range rc.known {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		if len(rep.Degraded) > 0 {
+			seen[key] = prev
+		} else {
+			resolved = append(resolved, prev)
+		}
+	}
+	rc.known = seen
+	rc.last = rep
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].key() < resolved[j].key() })
+	return fresh, resolved
+}
+
+// stamp fills in the first seen times the background reconciler has recorded without changing
+// them. Inconsistencies it has not recorded yet are first seen now.
+func (rc *reconciler) stamp(rep *ConsistencyReport) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, incs := range [][]*Inconsistency{rep.Inconsistencies, rep.Suppressed} {
+		for _, inc := range incs {
+			inc.FirstSeen = rep.GeneratedAt
+			if prev, ok := rc.known[inc.key()]; ok {
+				inc.FirstSeen = prev.FirstSeen
+			}
+		}
+	}
+}
+
+// consistencyWindow is the window adapters and transcoders are both read over for the report: the
+// longer of their own, so a stream that stopped a few minutes ago is either in both or in neither.
+func (s *server) consistencyWindow() time.Duration {
+	if s.transcoderWindow > s.adapterWindow {
+		return s.transcoderWindow
+	}
+	return s.adapterWindow
+}
+
+// report fetches every stage for r over one window and checks them, leaving first seen times unstamped.
+func (s *server) report(r *http.Request) (*ConsistencyReport, error) {
+	hd, err := s.fetchShared(r, s.consistencyWindow(), partCatchers, partAdapters, partTranscoders)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rep := checkConsistency(hd, now)
+	rep.suppress(s.offline(r.Context(), now), s.maintenance(r.Context(), now))
+	for _, inc := range rep.Inconsistencies {
+		inc.Station = s.catalog.lookup(inc.StreamID)
+	}
+	return rep, nil
+}
+
+// consistencyReport is the report for a page or API request. It reads first seen times but only the
+// background reconciler records them, so a narrow window or a filtered request cannot reset them.
+func (s *server) consistencyReport(r *http.Request) (*ConsistencyReport, error) {
+	rep, err := s.report(r)
+	if err != nil {
+		return nil, err
+	}
+	s.consistency.stamp(rep)
+	return rep, nil
+}
+
+func (inc *Inconsistency) alert(at time.Time, resolved bool) *Alert {
+	return &Alert{Time: at, Source: "consistency", Subject: inc.StreamID, Resolved: resolved,
+		Message: fmt.Sprintf("%s %s (catcher %s, adapter %s)", inc.StreamID, inc.Kind, inc.Catcher, inc.Adapter),
+		Streams: []string{inc.StreamID}, Hosts: uniq([]string{inc.Catcher, inc.Adapter})}
+}
+
+// reconcile checks the default window, records the result and alerts on inconsistencies that are new
+// or have cleared.
+func (s *server) reconcile(ctx context.Context) (*ConsistencyReport, error) {
+	r, _ := http.NewRequest("GET", "/api/consistency", nil)
+	rep, err := s.report(r.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	fresh, resolved := s.consistency.record(rep)
+	for _, inc := range fresh {
+		s.alerts.send(ctx, inc.alert(rep.GeneratedAt, false))
+	}
+	for _, inc := range resolved {
+		s.alerts.send(ctx, inc.alert(rep.GeneratedAt, true))
+	}
+	return rep, nil
+}
+
+// runReconciler reconciles every interval until ctx ends. It is the only place first seen times are
+// recorded and consistency alerts are sent.
+func (s *server) runReconciler(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		rep, err := s.reconcile(ctx)
+		if err != nil {
+			log.Error("reconcile failed %s", err)
+		} else if len(rep.Inconsistencies) > 0 {
+			log.Warning("%d pipeline inconsistencies", len(rep.Inconsistencies))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *server) Consistency(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rep, err := s.consistencyReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = templates.ExecuteTemplate(w, "consistency.html", rep)
+	if err != nil {
+		log.Error("error executing template %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *server) ConsistencyJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rep, err := s.consistencyReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveJson(w, rep)
+}
+
+// ConsistencyJUnit serves the report as JUnit XML, one test case per stream and per stage, so a
+// Jenkins job can fail on inconsistencies.
+func (s *server) ConsistencyJUnit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rep, err := s.consistencyReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := xml.MarshalIndent(rep.junit(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header+string(b))
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"timestamp,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func (rep *ConsistencyReport) junit() *junitSuite {
+	suite := &junitSuite{Name: "pipeline consistency", Time: rep.GeneratedAt.UTC().Format(time.RFC3339)}
+	for _, d := range rep.Degraded {
+		suite.Cases = append(suite.Cases, junitCase{Name: d.Source + " data", ClassName: "pipeline.sources",
+			Error: &junitMessage{Message: d.String()}})
+		suite.Errors++
+	}
+
+	byStream := make(map[string][]*Inconsistency)
+	var ids []string
+	for _, inc := range rep.Inconsistencies {
+		if _, ok := byStream[inc.StreamID]; !ok {
+			ids = append(ids, inc.StreamID)
+		}
+		byStream[inc.StreamID] = append(byStream[inc.StreamID], inc)
+	}
+	for _, id := range ids {
+		var kinds, lines []string
+		for _, inc := range byStream[id] {
+			kinds = append(kinds, inc.Kind)
+			lines = append(lines, fmt.Sprintf("%s since %s (catcher %s, adapter %s)", inc.Kind,
+				inc.FirstSeen.UTC().Format(time.RFC3339), inc.Catcher, inc.Adapter))
+		}
+		suite.Cases = append(suite.Cases, junitCase{Name: id, ClassName: "pipeline.streams",
+			Failure: &junitMessage{Message: strings.Join(kinds, ", "), Body: strings.Join(lines, "\n")}})
+		suite.Failures++
+	}
+	for _, inc := range rep.Suppressed {
+		suite.Cases = append(suite.Cases, junitCase{Name: inc.StreamID, ClassName: "pipeline.streams",
+			Skipped: &junitMessage{Message: inc.Kind + ", " + inc.Ignored}})
+		suite.Skipped++
+	}
+	if len(suite.Cases) == 0 {
+		suite.Cases = append(suite.Cases, junitCase{Name: fmt.Sprintf("%d streams consistent", rep.Caught), ClassName: "pipeline.streams"})
+	}
+	suite.Tests = len(suite.Cases)
+	return suite
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func streams(ids ...string) []*SourceStream {
+	var out []*SourceStream
+	for _, id := range ids {
+		out = append(out, &SourceStream{ID: id})
+	}
+	return out
+}
+
+func TestCheckConsistency(t *testing.T) {
+	hd := &HomeDisplay{
+		Catchers:    []*Catcher{{IP: "10.0.0.1", Streams: streams("A", "B", "C")}},
+		Adapters:    []*Adapter{{IP: "10.0.1.1", Streams: streams("B", "C", "D")}},
+		Transcoders: []*Transcoder{{Host: "t1", Streams: streams("C")}},
+	}
+	rep := checkConsistency(hd, time.Now())
+	assert.Equal(t, 3, rep.Caught)
+	assert.Equal(t, 3, rep.Adapted)
+	assert.Equal(t, 1, rep.Transcoded)
+
+	var got []string
+	for _, inc := range rep.Inconsistencies {
+		got = append(got, inc.StreamID+" "+inc.Kind)
+	}
+	assert.Equal(t, []string{"A " + notAdapted, "B " + notTranscoded, "D " + notCaught, "D " + notTranscoded}, got)
+
+	hd.Degraded = []*Degradation{{Source: partNames[partTranscoders]}}
+	rep = checkConsistency(hd, time.Now())
+	assert.Len(t, rep.Inconsistencies, 2, "transcoder checks are skipped without transcoder data")
+}
+
+func TestReconcilerFirstSeen(t *testing.T) {
+	hd := &HomeDisplay{
+		Catchers: []*Catcher{{IP: "10.0.0.1", Streams: streams("A")}},
+		Adapters: []*Adapter{{IP: "10.0.1.1"}},
+	}
+	rc := newReconciler()
+	start := time.Now()
+	rc.record(checkConsistency(hd, start))
+
+	later := start.Add(time.Minute)
+	rep := checkConsistency(hd, later)
+	rc.record(rep)
+	assert.Equal(t, start, rep.Inconsistencies[0].FirstSeen)
+
+	hd.Degraded = []*Degradation{{Source: partNames[partAdapters]}}
+	rc.record(checkConsistency(hd, later))
+	hd.Degraded = nil
+	rep = checkConsistency(hd, later)
+	rc.record(rep)
+	assert.Equal(t, start, rep.Inconsistencies[0].FirstSeen, "kept across an adapter outage")
+
+	hd.Adapters[0].Streams = streams("A")
+	rc.record(checkConsistency(hd, later))
+	hd.Adapters[0].Streams = nil
+	rep = checkConsistency(hd, later)
+	rc.record(rep)
+	assert.Equal(t, later, rep.Inconsistencies[0].FirstSeen, "reset once resolved")
+}
+
+func TestReconcilerAlerts(t *testing.T) {
+	hd := &HomeDisplay{
+		Catchers: []*Catcher{{IP: "10.0.0.1", Streams: streams("A", "B")}},
+		Adapters: []*Adapter{{IP: "10.0.1.1"}},
+	}
+	now := time.Now()
+	rc := newReconciler()
+	hd.Degraded = []*Degradation{{Source: partNames[partTranscoders]}}
+	fresh, resolved := rc.record(checkConsistency(hd, now))
+	assert.Len(t, fresh, 2, "inconsistencies found at startup alert")
+	hd.Degraded = nil
+	fresh, resolved = rc.record(checkConsistency(hd, now))
+	assert.Empty(t, fresh, "once")
+	assert.Empty(t, resolved)
+
+	hd.Catchers[0].Streams = streams("A", "C")
+	fresh, resolved = rc.record(checkConsistency(hd, now))
+	if assert.Len(t, fresh, 1) && assert.Len(t, resolved, 1) {
+		assert.Equal(t, "C", fresh[0].StreamID)
+		assert.Equal(t, "B", resolved[0].StreamID)
+	}
+
+	rep := checkConsistency(hd, now)
+	rep.suppress(nil, maintenanceSet{{Host: "10.0.0.1", Start: now.Add(-time.Hour), End: now.Add(time.Hour)}})
+	fresh, resolved = rc.record(rep)
+	assert.Empty(t, fresh)
+	assert.Empty(t, resolved, "suppressed inconsistencies have not cleared")
+	fresh, resolved = rc.record(checkConsistency(hd, now))
+	assert.Empty(t, fresh, "and do not alert again once the window ends")
+	assert.Empty(t, resolved)
+}
+
+func TestConsistencyEndpoints(t *testing.T) {
+	s := testServer(t)
+
+	w := get(s, "/api/consistency")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var rep ConsistencyReport
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &rep))
+	assert.Equal(t, 7, rep.Caught)
+	if assert.Len(t, rep.Inconsistencies, 1) {
+		assert.Equal(t, "WGGG-1007", rep.Inconsistencies[0].StreamID)
+		assert.Equal(t, notAdapted, rep.Inconsistencies[0].Kind)
+		assert.Equal(t, "10.10.1.21", rep.Inconsistencies[0].Catcher)
+	}
+
+	w = get(s, "/api/consistency.xml")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var suite junitSuite
+	assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &suite))
+	assert.Equal(t, 1, suite.Tests)
+	assert.Equal(t, 1, suite.Failures)
+	assert.Equal(t, "WGGG-1007", suite.Cases[0].Name)
+
+	w = get(s, "/consistency")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "WGGG-1007")
+
+	s.adapters = failing{err: errors.New("backend down")}
+	w = get(s, "/api/consistency.xml")
+	assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &suite))
+	assert.Equal(t, 1, suite.Errors)
+	assert.Equal(t, 0, suite.Failures)
+}
+
+// windowed records the windows adapters and transcoders are read over.
+type windowed struct {
+	*fixture
+	adapterWindows, transcoderWindows []window
+}
+
+func (f *windowed) Adapters(ctx context.Context, w window) ([]*Adapter, error) {
+	f.adapterWindows = append(f.adapterWindows, w)
+	return f.fixture.Adapters(ctx, w)
+}
+
+func (f *windowed) Transcoders(ctx context.Context, w window) ([]*Transcoder, error) {
+	f.transcoderWindows = append(f.transcoderWindows, w)
+	return f.fixture.Transcoders(ctx, w)
+}
+
+func TestReportSharesOneWindow(t *testing.T) {
+	s := testServer(t)
+	f := &windowed{fixture: s.adapters.(*fixture)}
+	s.adapters, s.transcoders = f, f
+	s.adapterWindow, s.transcoderWindow = 10*time.Minute, 4*time.Minute
+
+	assert.Equal(t, http.StatusOK, get(s, "/api/consistency").Code)
+	if assert.Len(t, f.adapterWindows, 1) && assert.Len(t, f.transcoderWindows, 1) {
+		assert.Equal(t, f.adapterWindows[0], f.transcoderWindows[0])
+		assert.Equal(t, 10*time.Minute, f.adapterWindows[0].To.Sub(f.adapterWindows[0].From))
+	}
+}
+
+func TestPagesLeaveFirstSeenAlone(t *testing.T) {
+	s := testServer(t)
+	get(s, "/api/consistency")
+	get(s, "/api/consistency?from=2019-01-01T00:00:00Z&to=2019-01-01T00:01:00Z")
+	assert.Empty(t, s.consistency.known, "only the background reconciler records")
+
+	first, err := s.reconcile(context.Background())
+	assert.Nil(t, err)
+	var rep ConsistencyReport
+	assert.Nil(t, json.Unmarshal(get(s, "/api/consistency").Body.Bytes(), &rep))
+	if assert.Len(t, rep.Inconsistencies, 1) {
+		assert.True(t, first.Inconsistencies[0].FirstSeen.Equal(rep.Inconsistencies[0].FirstSeen))
+	}
+}
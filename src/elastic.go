@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Syncbak-Git/elasticgo"
+	"github.com/Syncbak-Git/log"
+)
+
+// esPageSize is the most entries requested from elasticsearch in one query.
+const esPageSize = 2000
+
+// esMinSlice is the narrowest window findAll will split down to.
+const esMinSlice = time.Second
+
+// esFind returns at most max entries logged between start and end.
+type esFind func(ctx context.Context, start, end time.Time, max int) ([]elasticgo.Entry, error)
+
+// finderFor returns an esFind for entries logged by the named service. elasticgo takes no context, so
+// a cancelled query is abandoned rather than aborted: the caller returns at once and the request
+// finishes in the background.
+func finderFor(cluster, name string) esFind {
+	return func(ctx context.Context, start, end time.Time, max int) ([]elasticgo.Entry, error) {
+		var entries []elasticgo.Entry
+		err := within(ctx, 0, func(ctx context.Context) error {
+			f, err := elasticgo.NewFinderForCluster(cluster, start, end)
+			if err != nil {
+				return err
+			}
+			f.Client.MaxResults = max
+			res, err := f.Name(name).Find()
+			if err != nil {
+				return err
+			}
+			entries = res.Entries
+			return nil
+		})
+		return entries, err
+	}
+}
+
+// findAll retrieves every entry between start and end. A window that comes back full is split in
+// half and each half is fetched again, so a burst of logging can't push entries past the result cap.
+func findAll(ctx context.Context, find esFind, start, end time.Time) ([]elasticgo.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries, err := find(ctx, start, end, esPageSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) < esPageSize {
+		return entries, nil
+	}
+	if end.Sub(start) <= esMinSlice {
+		log.Warning("more than %d entries between %s and %s, some were not retrieved", esPageSize, start, end)
+		return entries, nil
+	}
+	mid := start.Add(end.Sub(start) / 2)
+	first, err := findAll(ctx, find, start, mid)
+	if err != nil {
+		return nil, err
+	}
+	second, err := findAll(ctx, find, mid, end)
+	if err != nil {
+		return nil, err
+	}
+	return append(first, second...), nil
+}
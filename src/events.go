@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Event kinds.
+const (
+	eventAssigned         = "assigned"
+	eventMoved            = "moved"
+	eventUnassigned       = "unassigned"
+	eventActiveFlipped    = "active host flipped"
+	eventRedirectAppeared = "redirect appeared"
+	eventRedirectVanished = "redirect disappeared"
+)
+
+const (
+	defaultEventLimit  = 500
+	defaultEventWindow = 24 * time.Hour
+)
+
+// Event is a change between two consecutive snapshots. Stage is the part of the pipeline it happened
+// in, catcher, adapter or redirect. Redirect events carry the redirect host in Host and no StreamID.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Stage    string    `json:"stage"`
+	Kind     string    `json:"kind"`
+	StreamID string    `json:"streamId,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to,omitempty"`
+}
+
+// involves reports whether host is the event's host or either side of it.
+func (e *Event) involves(host string) bool {
+	return e.Host == host || e.From == host || e.To == host
+}
+
+// eventLog is an append only file of events, one json object per line.
+type eventLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newEventLog(path string) *eventLog {
+	return &eventLog{path: path}
+}
+
+func (l *eventLog) append(events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// eventFilter selects events. Empty fields match everything.
+type eventFilter struct {
+	window   window
+	stage    string
+	kind     string
+	streamID string
+	host     string
+	limit    int
+}
+
+func (f *eventFilter) match(e *Event) bool {
+	return f.window.contains(e.Time) &&
+		(f.stage == "" || e.Stage == f.stage) &&
+		(f.kind == "" || e.Kind == f.kind) &&
+		(f.streamID == "" || e.StreamID == f.streamID) &&
+		(f.host == "" || e.involves(f.host))
+}
+
+// query returns the newest events matching f, newest first. A missing file has no events.
+func (l *eventLog) query(f *eventFilter) ([]*Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := []*Event{}
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return events, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		e := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			log.Error("skipping bad event %q in %s: %s", scanner.Text(), l.path, err)
+			continue
+		}
+		if f.match(e) {
+			events = append(events, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	if f.limit > 0 && len(events) > f.limit {
+		events = events[:f.limit]
+	}
+	return events, nil
+}
+
+// tracker takes snapshots, logs the events between consecutive ones and, when it has a store, keeps
+// every snapshot that differs from the one before.
+type tracker struct {
+	log       *eventLog
+	snapshots *snapshotStore
+	mu        sync.Mutex
+	prev      *snapshot
+	resumed   bool
+}
+
+func newTracker(l *eventLog, st *snapshotStore) *tracker {
+	return &tracker{log: l, snapshots: st}
+}
+
+// observe records hd as the latest snapshot and logs what changed since the previous one. After a
+// start the previous snapshot is the last one stored, or without one the first snapshot is only a
+// baseline.
+func (t *tracker) observe(hd *HomeDisplay, limits *capacityLimits, now time.Time) ([]*Event, error) {
+	cur := snapshotOf(hd, limits, now)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.resumed && t.snapshots != nil {
+		t.resumed = true
+		prev, err := t.snapshots.at(now)
+		if err != nil {
+			log.Error("could not resume from %s: %s", t.snapshots.path, err)
+		}
+		t.prev = prev
+	}
+	if t.prev == nil {
+		t.prev = cur
+		return nil, t.store(cur)
+	}
+	cur.carryOver(t.prev)
+	events := diffSnapshots(t.prev, cur)
+	changed := !cur.sameState(t.prev)
+	t.prev = cur
+	if err := t.log.append(events); err != nil {
+		return events, err
+	}
+	if !changed {
+		return events, nil
+	}
+	return events, t.store(cur)
+}
+
+func (t *tracker) store(snap *snapshot) error {
+	if t.snapshots == nil {
+		return nil
+	}
+	return t.snapshots.append(snap)
+}
+
+// runTracker snapshots every backend every interval until ctx ends.
+func (s *server) runTracker(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		r, _ := http.NewRequest("GET", "/events", nil)
+		hd, err := s.fetch(r.WithContext(ctx), partCatchers, partAdapters, partTranscoders, partRedirects)
+		if err == nil {
+			var events []*Event
+			events, err = s.tracker.observe(hd, s.limits(ctx), time.Now())
+			if len(events) > 0 {
+				log.Info("%d stream events", len(events))
+			}
+		}
+		if err != nil {
+			log.Error("snapshot failed %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// EventsDisplay is the events page.
+type EventsDisplay struct {
+	Events []*Event
+	Window window
+	Since  string
+	From   string
+	To     string
+	Stage  string
+	Kind   string
+	Stream string
+	Host   string
+	Kinds  []string
+	// Notes are the operator annotations on the stream or host filtered on.
+	Notes annotations
+}
+
+// events reads the events asked for by r's query, writing an error response if it cannot.
+func (s *server) events(w http.ResponseWriter, r *http.Request) (*EventsDisplay, bool) {
+	if s.tracker == nil {
+		http.Error(w, "no event log configured", http.StatusNotFound)
+		return nil, false
+	}
+	win, ok := s.window(w, r, defaultEventWindow)
+	if !ok {
+		return nil, false
+	}
+	q := r.URL.Query()
+	f := &eventFilter{window: win, stage: q.Get("stage"), kind: q.Get("kind"), streamID: q.Get("stream"),
+		host: q.Get("host"), limit: defaultEventLimit}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return nil, false
+		}
+		f.limit = n
+	}
+	events, err := s.tracker.log.query(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	ed := &EventsDisplay{Events: events, Window: win, Since: q.Get("since"), From: q.Get("from"), To: q.Get("to"),
+		Stage: f.stage, Kind: f.kind, Stream: f.streamID, Host: f.host,
+		Kinds: []string{eventAssigned, eventMoved, eventUnassigned, eventActiveFlipped, eventRedirectAppeared, eventRedirectVanished}}
+	if f.streamID != "" || f.host != "" {
+		ed.Notes = s.annotations(r.Context()).on(f.streamID, f.host)
+	}
+	return ed, true
+}
+
+func (s *server) Events(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ed, ok := s.events(w, r)
+	if !ok {
+		return
+	}
+	err := templates.ExecuteTemplate(w, "events.html", ed)
+	if err != nil {
+		log.Error("error executing template %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *server) EventsJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ed, ok := s.events(w, r)
+	if !ok {
+		return
+	}
+	serveJson(w, ed.Events)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempEventLog(t *testing.T) (*eventLog, func()) {
+	dir, err := ioutil.TempDir("", "events")
+	assert.Nil(t, err, "%s", err)
+	return newEventLog(filepath.Join(dir, "events.jsonl")), func() { os.RemoveAll(dir) }
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	prev := &snapshot{
+		Catchers: map[string]*placementRef{
+			"A": {Host: "catcher01", ActiveHost: "catcher01"},
+			"B": {Host: "catcher01", ActiveHost: "catcher01"},
+			"C": {Host: "catcher02"},
+		},
+		Adapters:  map[string]string{"A": "10.0.1.1", "B": "10.0.1.1"},
+		Redirects: map[string]int{"redirect01": 1500},
+	}
+	cur := &snapshot{
+		Time: time.Now(),
+		Catchers: map[string]*placementRef{
+			"A": {Host: "catcher02", ActiveHost: "catcher01"},
+			"B": {Host: "catcher01", ActiveHost: "catcher02"},
+			"D": {Host: "catcher03"},
+		},
+		Adapters:  map[string]string{"A": "10.0.1.2", "D": "10.0.1.1"},
+		Redirects: map[string]int{"redirect02": 1500},
+	}
+	var got []Event
+	for _, e := range diffSnapshots(prev, cur) {
+		assert.Equal(t, cur.Time, e.Time)
+		e.Time = time.Time{}
+		got = append(got, *e)
+	}
+	assert.Equal(t, []Event{
+		{Stage: "adapter", Kind: eventMoved, StreamID: "A", From: "10.0.1.1", To: "10.0.1.2"},
+		{Stage: "adapter", Kind: eventUnassigned, StreamID: "B", From: "10.0.1.1"},
+		{Stage: "adapter", Kind: eventAssigned, StreamID: "D", To: "10.0.1.1"},
+		{Stage: "catcher", Kind: eventMoved, StreamID: "A", From: "catcher01", To: "catcher02"},
+		{Stage: "catcher", Kind: eventActiveFlipped, StreamID: "B", Host: "catcher01", From: "catcher01", To: "catcher02"},
+		{Stage: "catcher", Kind: eventUnassigned, StreamID: "C", From: "catcher02"},
+		{Stage: "catcher", Kind: eventAssigned, StreamID: "D", To: "catcher03"},
+		{Stage: "redirect", Kind: eventRedirectVanished, Host: "redirect01"},
+		{Stage: "redirect", Kind: eventRedirectAppeared, Host: "redirect02"},
+	}, got)
+
+	cur.Adapters = nil
+	for _, e := range diffSnapshots(prev, cur) {
+		assert.NotEqual(t, "adapter", e.Stage, "no adapter events without adapter data")
+	}
+}
+
+func TestTrackerLogsEvents(t *testing.T) {
+	l, cleanup := tempEventLog(t)
+	defer cleanup()
+	s := testServer(t)
+	s.tracker = newTracker(l, nil)
+	f := s.catchers.(*fixture)
+
+	observe := func(degraded ...*Degradation) []*Event {
+		hd, err := s.fetch(httptest.NewRequest("GET", "/", nil), partCatchers, partAdapters, partRedirects)
+		assert.Nil(t, err)
+		hd.Degraded = append(hd.Degraded, degraded...)
+		events, err := s.tracker.observe(hd, s.limits(context.Background()), time.Now())
+		assert.Nil(t, err, "%s", err)
+		return events
+	}
+	assert.Empty(t, observe(), "the first snapshot is a baseline")
+
+	moved := f.CatcherList[2].Streams[1]
+	f.CatcherList[2].Streams = f.CatcherList[2].Streams[:1]
+	f.CatcherList[1].Streams = append(f.CatcherList[1].Streams, moved)
+	events := observe()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, &Event{Time: events[0].Time, Stage: "catcher", Kind: eventMoved, StreamID: "WGGG-1007",
+			From: "catcher03", To: "catcher02"}, events[0])
+	}
+
+	// An outage is not logged as every stream leaving.
+	s.catchers = failing{err: os.ErrClosed}
+	assert.Empty(t, observe(&Degradation{Source: partNames[partAdapters]}))
+	s.catchers = f
+	assert.Empty(t, observe())
+
+	w := get(s, "/api/events?stream=WGGG-1007")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var logged []*Event
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &logged))
+	assert.Len(t, logged, 1)
+
+	for query, want := range map[string]int{"host=catcher03": 1, "host=catcher01": 0, "kind=moved": 1, "stage=adapter": 0, "since=1h": 1} {
+		w := get(s, "/api/events?"+query)
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &logged))
+		assert.Len(t, logged, want, query)
+	}
+	w = get(s, "/events?stage=catcher")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "WGGG-1007")
+}
+
+func TestEventLogQuery(t *testing.T) {
+	l, cleanup := tempEventLog(t)
+	defer cleanup()
+	now := time.Now().Truncate(time.Second)
+
+	events, err := l.query(&eventFilter{window: lastWindow(time.Hour, now)})
+	assert.Nil(t, err)
+	assert.Empty(t, events, "no file yet")
+
+	assert.Nil(t, l.append([]*Event{
+		{Time: now.Add(-2 * time.Hour), StreamID: "A"},
+		{Time: now.Add(-time.Minute), StreamID: "B"},
+		{Time: now, StreamID: "C"},
+	}))
+	events, err = l.query(&eventFilter{window: lastWindow(time.Hour, now)})
+	assert.Nil(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "C", events[0].StreamID, "newest first")
+	}
+	events, _ = l.query(&eventFilter{window: lastWindow(time.Hour, now), limit: 1})
+	assert.Len(t, events, 1)
+}
+
+func TestEventsNotConfigured(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, get(testServer(t), "/api/events").Code)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// part is one backend a page can ask fetch for.
+type part int
+
+const (
+	partCatchers part = iota
+	partRedirects
+	partAdapters
+	partTranscoders
+)
+
+var partNames = map[part]string{
+	partCatchers:    "catcher",
+	partRedirects:   "redirect",
+	partAdapters:    "adapter",
+	partTranscoders: "transcoder",
+}
+
+// Degradation records a backend whose data is missing from a page.
+type Degradation struct {
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+func (d *Degradation) String() string {
+	return fmt.Sprintf("degraded: %s data unavailable (%s)", d.Source, d.Reason)
+}
+
+// fetch queries the requested backends concurrently, each under its own timeout, and returns whatever
+// succeeded. Backends that failed are listed in Degraded. An error is only returned for a bad window
+// query, which nothing could be fetched for.
+func (s *server) fetch(r *http.Request, parts ...part) (*HomeDisplay, error) {
+	hd := &HomeDisplay{}
+	now := time.Now()
+	windows := make(map[part]window)
+	for _, p := range parts {
+		def, ok := s.defaultWindow(p)
+		if !ok {
+			continue
+		}
+		w, err := requestWindow(r, def, now)
+		if err != nil {
+			return nil, err
+		}
+		windows[p] = w
+		if hd.Window.From.IsZero() {
+			hd.setWindow(r, w)
+		}
+	}
+	return s.fetchWindows(r, hd, windows, parts), nil
+}
+
+// fetchShared is fetch with every backend read over the same window, def long unless r asks for
+// another, so data from different stages can be compared.
+func (s *server) fetchShared(r *http.Request, def time.Duration, parts ...part) (*HomeDisplay, error) {
+	w, err := requestWindow(r, def, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	hd := &HomeDisplay{}
+	hd.setWindow(r, w)
+	windows := make(map[part]window)
+	for _, p := range parts {
+		windows[p] = w
+	}
+	return s.fetchWindows(r, hd, windows, parts), nil
+}
+
+func (s *server) fetchWindows(r *http.Request, hd *HomeDisplay, windows map[part]window, parts []part) *HomeDisplay {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range parts {
+		wg.Add(1)
+		go func(p part) {
+			defer wg.Done()
+			err := s.fetchPart(r.Context(), hd, &mu, p, windows[p])
+			if err != nil {
+				mu.Lock()
+				hd.Degraded = append(hd.Degraded, &Degradation{Source: partNames[p], Reason: err.Error()})
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	s.catalog.enrich(hd)
+	sort.Slice(hd.Degraded, func(i, j int) bool {
+		return hd.Degraded[i].Source < hd.Degraded[j].Source
+	})
+	return hd
+}
+
+func (s *server) defaultWindow(p part) (time.Duration, bool) {
+	switch p {
+	case partRedirects:
+		return s.redirectWindow, true
+	case partAdapters:
+		return s.adapterWindow, true
+	case partTranscoders:
+		return s.transcoderWindow, true
+	}
+	return 0, false
+}
+
+// fetchPart reads one backend and stores the result in hd under mu. Results that arrive after the
+// timeout are dropped.
+func (s *server) fetchPart(ctx context.Context, hd *HomeDisplay, mu *sync.Mutex, p part, w window) error {
+	switch p {
+	case partCatchers:
+		var cs []*Catcher
+		err := s.call(ctx, p, func(ctx context.Context) (err error) {
+			cs, err = s.catchers.Catchers(ctx)
+			return err
+		})
+		if err == nil {
+			mu.Lock()
+			hd.Catchers = cs
+			mu.Unlock()
+		}
+		return err
+	case partRedirects:
+		var rds []*RedirectHost
+		err := s.call(ctx, p, func(ctx context.Context) (err error) {
+			rds, err = s.redirects.Redirects(ctx, w)
+			return err
+		})
+		if err == nil {
+			mu.Lock()
+			hd.Redirects = rds
+			mu.Unlock()
+		}
+		return err
+	case partAdapters:
+		var as []*Adapter
+		err := s.call(ctx, p, func(ctx context.Context) (err error) {
+			as, err = s.adapters.Adapters(ctx, w)
+			return err
+		})
+		if err == nil {
+			mu.Lock()
+			hd.Adapters = as
+			hd.SplitStreams = splitStreams(as)
+			mu.Unlock()
+		}
+		return err
+	case partTranscoders:
+		var ts []*Transcoder
+		err := s.call(ctx, p, func(ctx context.Context) (err error) {
+			ts, err = s.transcoders.Transcoders(ctx, w)
+			return err
+		})
+		if err == nil {
+			mu.Lock()
+			hd.Transcoders = ts
+			mu.Unlock()
+		}
+		return err
+	}
+	return fmt.Errorf("unknown part %d", p)
+}
+
+func (s *server) timeout(p part) time.Duration {
+	switch p {
+	case partCatchers:
+		return s.catcherTimeout
+	case partRedirects:
+		return s.redirectTimeout
+	case partAdapters:
+		return s.adapterTimeout
+	case partTranscoders:
+		return s.transcoderTimeout
+	}
+	return 0
+}
+
+// call runs f against backend p under its timeout and circuit breaker. A timeout counts as a failure,
+// so a slow backend trips its breaker and later calls fail fast instead of waiting it out again. f is
+// given a context that ends with the timeout or with the request.
+func (s *server) call(ctx context.Context, p part, f func(ctx context.Context) error) error {
+	return s.breakers[p].do(ctx, func() error {
+		return within(ctx, s.timeout(p), f)
+	})
+}
+
+// breakerStatus reports every backend's breaker in part order.
+func (s *server) breakerStatus() []*BreakerStatus {
+	var st []*BreakerStatus
+	for _, p := range []part{partCatchers, partRedirects, partAdapters, partTranscoders} {
+		if b, ok := s.breakers[p]; ok {
+			st = append(st, b.status())
+		}
+	}
+	return st
+}
+
+// within runs f and waits at most timeout for it to finish, or for ctx to end when timeout is zero. f
+// is passed the bounded context and should stop when it ends, but within does not wait for it, so f
+// must only write to variables the caller reads when within returns nil.
+func within(ctx context.Context, timeout time.Duration, f func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timeout after %s", timeout)
+		}
+		return ctx.Err()
+	}
+}
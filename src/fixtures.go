@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// fixture is a canned snapshot of every backend. It implements all of the source interfaces so
+// handlers can run without redis or elasticsearch, both in tests and in demo mode. Windows are
+// ignored, every query sees the whole snapshot.
+type fixture struct {
+	CatcherList    []*Catcher      `json:"catchers"`
+	AdapterList    []*Adapter      `json:"adapters"`
+	TranscoderList []*Transcoder   `json:"transcoders"`
+	RedirectList   []*RedirectHost `json:"redirects"`
+	ActiveStreams  int             `json:"activeStreams"`
+	Workers        float64         `json:"workers"`
+	// live restamps every timestamp with the current time so a demo never looks stale.
+	live bool
+}
+
+func loadFixture(path string) (*fixture, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &fixture{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, err
+	}
+	f.live = true
+	return f, nil
+}
+
+// The accessors return copies so callers, and the restamping in live mode, never share the fixture's
+// values with concurrent requests.
+
+func (f *fixture) Catchers(ctx context.Context) ([]*Catcher, error) {
+	now := time.Now()
+	out := make([]*Catcher, len(f.CatcherList))
+	for i, c := range f.CatcherList {
+		cp := *c
+		cp.Streams = f.streams(c.Streams, now)
+		if f.live {
+			cp.FetchedAt = now
+		}
+		out[i] = &cp
+	}
+	return out, nil
+}
+
+func (f *fixture) Adapters(ctx context.Context, w window) ([]*Adapter, error) {
+	now := time.Now()
+	out := make([]*Adapter, len(f.AdapterList))
+	for i, a := range f.AdapterList {
+		cp := *a
+		cp.Streams = f.streams(a.Streams, now)
+		if f.live {
+			cp.LastSeen = now
+		}
+		out[i] = &cp
+	}
+	return out, nil
+}
+
+func (f *fixture) Transcoders(ctx context.Context, w window) ([]*Transcoder, error) {
+	now := time.Now()
+	out := make([]*Transcoder, len(f.TranscoderList))
+	for i, t := range f.TranscoderList {
+		cp := *t
+		cp.Streams = f.streams(t.Streams, now)
+		if f.live {
+			cp.LastSeen = now
+		}
+		out[i] = &cp
+	}
+	return out, nil
+}
+
+func (f *fixture) ActiveStreamCount(ctx context.Context, w window) (int, error) {
+	return f.ActiveStreams, nil
+}
+
+func (f *fixture) WorkersInUse(ctx context.Context, w window) (float64, error) {
+	return f.Workers, nil
+}
+
+func (f *fixture) Redirects(ctx context.Context, w window) ([]*RedirectHost, error) {
+	now := time.Now()
+	out := make([]*RedirectHost, len(f.RedirectList))
+	for i, r := range f.RedirectList {
+		cp := *r
+		if f.live {
+			cp.Timestamp = now
+		}
+		out[i] = &cp
+	}
+	return out, nil
+}
+
+// streams copies streams, restamped with now in live mode.
+func (f *fixture) streams(streams []*SourceStream, now time.Time) []*SourceStream {
+	if streams == nil {
+		return nil
+	}
+	out := make([]*SourceStream, len(streams))
+	for i, s := range streams {
+		cp := *s
+		if f.live {
+			cp.LastSeen = now
+		}
+		out[i] = &cp
+	}
+	return out
+}
+
+// failing is a source whose every call returns err.
+type failing struct {
+	err error
+}
+
+func (f failing) Catchers(ctx context.Context) ([]*Catcher, error)                 { return nil, f.err }
+func (f failing) Adapters(ctx context.Context, w window) ([]*Adapter, error)       { return nil, f.err }
+func (f failing) Transcoders(ctx context.Context, w window) ([]*Transcoder, error) { return nil, f.err }
+func (f failing) ActiveStreamCount(ctx context.Context, w window) (int, error)     { return 0, f.err }
+func (f failing) WorkersInUse(ctx context.Context, w window) (float64, error)      { return 0, f.err }
+func (f failing) Redirects(ctx context.Context, w window) ([]*RedirectHost, error) { return nil, f.err }
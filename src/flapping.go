@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultFlapThreshold = 3
+	defaultFlapWindow    = time.Hour
+)
+
+// FlappingStream is a source stream that keeps changing catcher, adapter or active host.
+type FlappingStream struct {
+	StreamID string `json:"streamId"`
+	Changes  int    `json:"changes"`
+	// History is the stream's moves and active host flips, oldest first.
+	History []*Event     `json:"history"`
+	Station *StationInfo `json:"station,omitempty"`
+}
+
+// flaps reports whether e is a change that counts towards flapping. Streams being assigned or
+// unassigned are coming and going rather than flapping.
+func flaps(e *Event) bool {
+	switch e.Stage {
+	case partNames[partCatchers]:
+		return e.Kind == eventMoved || e.Kind == eventActiveFlipped
+	case partNames[partAdapters]:
+		return e.Kind == eventMoved
+	}
+	return false
+}
+
+// flappingStreams returns the streams with more than threshold changes among events, most changes
+// first.
+func flappingStreams(events []*Event, threshold int) []*FlappingStream {
+	byStream := make(map[string]*FlappingStream)
+	for _, e := range events {
+		if !flaps(e) {
+			continue
+		}
+		fs, ok := byStream[e.StreamID]
+		if !ok {
+			fs = &FlappingStream{StreamID: e.StreamID}
+			byStream[e.StreamID] = fs
+		}
+		fs.Changes++
+		fs.History = append(fs.History, e)
+	}
+	out := []*FlappingStream{}
+	for _, fs := range byStream {
+		if fs.Changes <= threshold {
+			continue
+		}
+		sort.SliceStable(fs.History, func(i, j int) bool {
+			return fs.History[i].Time.Before(fs.History[j].Time)
+		})
+		out = append(out, fs)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Changes != out[j].Changes {
+			return out[i].Changes > out[j].Changes
+		}
+		return out[i].StreamID < out[j].StreamID
+	})
+	return out
+}
+
+// flapping returns the streams flapping within w, or nil without an event log.
+func (s *server) flapping(w window, threshold int) ([]*FlappingStream, error) {
+	if s.tracker == nil {
+		return nil, nil
+	}
+	events, err := s.tracker.log.query(&eventFilter{window: w})
+	if err != nil {
+		return nil, err
+	}
+	flapping := flappingStreams(events, threshold)
+	for _, f := range flapping {
+		f.Station = s.catalog.lookup(f.StreamID)
+	}
+	return flapping, nil
+}
+
+func (s *server) flapThresholdOrDefault() int {
+	if s.flapThreshold <= 0 {
+		return defaultFlapThreshold
+	}
+	return s.flapThreshold
+}
+
+// FlappingJSON serves the flapping streams for the since or from and to window, and the threshold
+// query parameter when given.
+func (s *server) FlappingJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.tracker == nil {
+		http.Error(w, "no event log configured", http.StatusNotFound)
+		return
+	}
+	win, ok := s.window(w, r, durationOr(s.flapWindow, defaultFlapWindow))
+	if !ok {
+		return
+	}
+	threshold := s.flapThresholdOrDefault()
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "threshold must be a whole number", http.StatusBadRequest)
+			return
+		}
+		threshold = n
+	}
+	fs, err := s.flapping(win, threshold)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveJson(w, fs)
+}
+
+// pageFlapping is the flapping panel for a page, logged rather than failing the page on error.
+func (s *server) pageFlapping(now time.Time) []*FlappingStream {
+	fs, err := s.flapping(lastWindow(durationOr(s.flapWindow, defaultFlapWindow), now), s.flapThresholdOrDefault())
+	if err != nil {
+		log.Error("could not read flapping streams %s", err)
+	}
+	return fs
+}
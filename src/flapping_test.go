@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func flapEvents(now time.Time) []*Event {
+	var events []*Event
+	for i := 0; i < 5; i++ {
+		at := now.Add(time.Duration(i-5) * time.Minute)
+		events = append(events,
+			&Event{Time: at, Stage: "catcher", Kind: eventActiveFlipped, StreamID: "KAAA-1001", From: "catcher01", To: "catcher02"},
+			&Event{Time: at, Stage: "adapter", Kind: eventAssigned, StreamID: "KBBB-1002", To: "10.10.2.11"})
+		if i < 4 {
+			events = append(events, &Event{Time: at, Stage: "adapter", Kind: eventMoved, StreamID: "WCCC-1003", From: "10.10.2.11", To: "10.10.2.12"})
+		}
+		if i < 3 {
+			events = append(events, &Event{Time: at, Stage: "catcher", Kind: eventMoved, StreamID: "KEEE-1005", From: "catcher02", To: "catcher01"})
+		}
+	}
+	return events
+}
+
+func TestFlappingStreams(t *testing.T) {
+	fs := flappingStreams(flapEvents(time.Now()), 3)
+	if assert.Len(t, fs, 2) {
+		assert.Equal(t, "KAAA-1001", fs[0].StreamID)
+		assert.Equal(t, 5, fs[0].Changes)
+		assert.Equal(t, "WCCC-1003", fs[1].StreamID)
+		assert.True(t, fs[1].History[0].Time.Before(fs[1].History[3].Time))
+	}
+	assert.Len(t, flappingStreams(flapEvents(time.Now()), 2), 3)
+}
+
+func TestFlappingPanel(t *testing.T) {
+	l, cleanup := tempEventLog(t)
+	defer cleanup()
+	s := testServer(t)
+	assert.NotContains(t, get(s, "/").Body.String(), "Flapping streams")
+	assert.Equal(t, http.StatusNotFound, get(s, "/api/flapping").Code)
+
+	s.tracker = newTracker(l, nil)
+	now := time.Now()
+	assert.Nil(t, l.append(flapEvents(now)))
+	assert.Nil(t, l.append([]*Event{{Time: now.Add(-2 * time.Hour), Stage: "catcher", Kind: eventMoved, StreamID: "WCCC-1003"}}))
+
+	var fs []*FlappingStream
+	w := get(s, "/api/flapping")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &fs))
+	assert.Len(t, fs, 2)
+
+	w = get(s, "/api/flapping?since=3h&threshold=4")
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &fs))
+	if assert.Len(t, fs, 2) {
+		assert.Equal(t, 5, fs[1].Changes, "the older move counts in a longer window")
+	}
+	assert.Equal(t, http.StatusBadRequest, get(s, "/api/flapping?threshold=x").Code)
+
+	body := get(s, "/").Body.String()
+	assert.Contains(t, body, "Flapping streams")
+	assert.Contains(t, body, "KAAA-1001")
+	assert.Contains(t, get(s, "/adapters").Body.String(), "Flapping streams")
+	assert.NotContains(t, get(s, "/transcoders").Body.String(), "Flapping streams")
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/garyburd/redigo/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Station is an entry in the expected lineup.
+type Station struct {
+	CallSign string `json:"callSign"`
+	StreamID string `json:"streamId"`
+	// HostType is the catcher host type the station should be on, any when empty.
+	HostType string `json:"hostType,omitempty"`
+	// Redundancy is how many catchers should carry the station: 1 for a primary alone, 2 for a primary
+	// and a backup. Zero is treated as 1.
+	Redundancy int `json:"redundancy,omitempty"`
+	// Blackouts are when the station is expected to be off the air.
+	Blackouts []*Blackout `json:"blackouts,omitempty"`
+}
+
+func (st *Station) validate() error {
+	if st.StreamID == "" {
+		return fmt.Errorf("streamId is required")
+	}
+	if st.Redundancy < 0 || st.Redundancy > 2 {
+		return fmt.Errorf("redundancy must be 1 or 2, got %d", st.Redundancy)
+	}
+	for _, b := range st.Blackouts {
+		if _, err := b.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lineupStore holds the expected lineup keyed by stream id.
+type lineupStore interface {
+	Stations(ctx context.Context) ([]*Station, error)
+	Put(ctx context.Context, st *Station) error
+	Delete(ctx context.Context, streamID string) error
+}
+
+func sortStations(stations []*Station) {
+	sort.Slice(stations, func(i, j int) bool {
+		return stations[i].StreamID < stations[j].StreamID
+	})
+}
+
+// fileLineup keeps the lineup in a json file holding a list of stations.
+type fileLineup struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newFileLineup(path string) *fileLineup {
+	return &fileLineup{path: path}
+}
+
+func (f *fileLineup) read() ([]*Station, error) {
+	stations := []*Station{}
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return stations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &stations); err != nil {
+		return nil, fmt.Errorf("could not read lineup %s: %s", f.path, err)
+	}
+	return stations, nil
+}
+
+// write replaces the file through a rename so readers never see half a lineup.
+func (f *fileLineup) write(stations []*Station) error {
+	sortStations(stations)
+	b, err := json.MarshalIndent(stations, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), ".lineup")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *fileLineup) Stations(_ context.Context) ([]*Station, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stations, err := f.read()
+	if err == nil {
+		sortStations(stations)
+	}
+	return stations, err
+}
+
+func (f *fileLineup) Put(_ context.Context, st *Station) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stations, err := f.read()
+	if err != nil {
+		return err
+	}
+	kept := []*Station{st}
+	for _, s := range stations {
+		if s.StreamID != st.StreamID {
+			kept = append(kept, s)
+		}
+	}
+	return f.write(kept)
+}
+
+func (f *fileLineup) Delete(_ context.Context, streamID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stations, err := f.read()
+	if err != nil {
+		return err
+	}
+	kept := []*Station{}
+	for _, s := range stations {
+		if s.StreamID != streamID {
+			kept = append(kept, s)
+		}
+	}
+	return f.write(kept)
+}
+
+// redisLineup keeps the lineup in a redis hash of stream id to station json.
+type redisLineup struct {
+	redisServer
+	key string
+}
+
+func newRedisLineup(rs redisServer, key string) *redisLineup {
+	return &redisLineup{redisServer: rs, key: key}
+}
+
+func (db *redisLineup) Stations(ctx context.Context) ([]*Station, error) {
+	vals, err := redis.StringMap(db.do(ctx, "HGETALL", db.key))
+	if err != nil {
+		return nil, err
+	}
+	stations := []*Station{}
+	for id, val := range vals {
+		st := &Station{}
+		if err := json.Unmarshal([]byte(val), st); err != nil {
+			log.Error("skipping bad lineup entry %s %q in %s: %s", id, val, db.key, err)
+			continue
+		}
+		st.StreamID = id
+		stations = append(stations, st)
+	}
+	sortStations(stations)
+	return stations, nil
+}
+
+func (db *redisLineup) Put(ctx context.Context, st *Station) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	_, err = db.do(ctx, "HSET", db.key, st.StreamID, b)
+	return err
+}
+
+func (db *redisLineup) Delete(ctx context.Context, streamID string) error {
+	_, err := db.do(ctx, "HDEL", db.key, streamID)
+	return err
+}
+
+// Lineup problems.
+const (
+	lineupMissing    = "missing"
+	lineupUnexpected = "unexpected"
+	lineupWrongType  = "wrong host type"
+	lineupNoBackup   = "no backup"
+)
+
+// LineupProblem is a difference between the expected lineup and the catchers.
+type LineupProblem struct {
+	StreamID string `json:"streamId"`
+	CallSign string `json:"callSign,omitempty"`
+	Problem  string `json:"problem"`
+	// Catcher and HostType are where the stream actually is, empty when it is missing.
+	Catcher  string       `json:"catcher,omitempty"`
+	HostType string       `json:"hostType,omitempty"`
+	Expected string       `json:"expected,omitempty"`
+	Station  *StationInfo `json:"station,omitempty"`
+	// Inferred is set on a missing backup when it was judged from the catcher's partner, see
+	// checkPlacement.
+	Inferred bool `json:"inferred,omitempty"`
+}
+
+// LineupReport compares the expected lineup with what the nameservice has assigned.
+type LineupReport struct {
+	Stations []*Station       `json:"stations"`
+	Problems []*LineupProblem `json:"problems"`
+	// Offline holds the stations in a blackout keyed by stream id.
+	Offline map[string]*Offline `json:"offline"`
+}
+
+// checkLineup flags stations missing from every catcher, streams on a catcher that are not in the
+// lineup, stations on the wrong host type and stations needing a backup that have none. Stations
+// expected to be offline are not checked.
+func checkLineup(stations []*Station, catchers []*Catcher, offline map[string]*Offline) []*LineupProblem {
+	type placed struct {
+		c *Catcher
+		s *SourceStream
+	}
+	on := make(map[string]placed)
+	for _, c := range catchers {
+		for _, s := range c.Streams {
+			on[s.ID] = placed{c, s}
+		}
+	}
+	partners := partnerHosts(catchers)
+	expected := make(map[string]bool)
+	problems := []*LineupProblem{}
+	for _, st := range stations {
+		expected[st.StreamID] = true
+		if offline[st.StreamID] != nil {
+			continue
+		}
+		p, ok := on[st.StreamID]
+		if !ok {
+			problems = append(problems, &LineupProblem{StreamID: st.StreamID, CallSign: st.CallSign, Problem: lineupMissing,
+				Expected: st.HostType})
+			continue
+		}
+		if st.HostType != "" && p.c.Type != st.HostType {
+			problems = append(problems, &LineupProblem{StreamID: st.StreamID, CallSign: st.CallSign, Problem: lineupWrongType,
+				Catcher: catcherName(p.c), HostType: p.c.Type, Expected: st.HostType})
+		}
+		if backup, inferred := backupHost(p.c, p.s, partners); st.Redundancy > 1 && backup == "" {
+			problems = append(problems, &LineupProblem{StreamID: st.StreamID, CallSign: st.CallSign, Problem: lineupNoBackup,
+				Catcher: catcherName(p.c), HostType: p.c.Type, Inferred: inferred})
+		}
+	}
+	for id, p := range on {
+		if !expected[id] {
+			problems = append(problems, &LineupProblem{StreamID: id, Problem: lineupUnexpected, Catcher: catcherName(p.c), HostType: p.c.Type})
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].StreamID != problems[j].StreamID {
+			return problems[i].StreamID < problems[j].StreamID
+		}
+		return problems[i].Problem < problems[j].Problem
+	})
+	return problems
+}
+
+// lineupReport compares the lineup with the catchers for r, writing an error response if it cannot.
+func (s *server) lineupReport(w http.ResponseWriter, r *http.Request) (*LineupReport, bool) {
+	if s.lineup == nil {
+		http.Error(w, "no lineup configured", http.StatusNotFound)
+		return nil, false
+	}
+	stations, err := s.lineup.Stations(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	hd, ok := s.one(w, r, partCatchers)
+	if !ok {
+		return nil, false
+	}
+	offline := offlineStations(s.catalog.withTimezones(stations), time.Now())
+	rep := &LineupReport{Stations: stations, Problems: checkLineup(stations, hd.Catchers, offline), Offline: offline}
+	for _, p := range rep.Problems {
+		p.Station = s.catalog.lookup(p.StreamID)
+	}
+	return rep, true
+}
+
+func (s *server) Lineup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rep, ok := s.lineupReport(w, r)
+	if !ok {
+		return
+	}
+	err := templates.ExecuteTemplate(w, "lineup.html", rep)
+	if err != nil {
+		log.Error("error executing template %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *server) LineupJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rep, ok := s.lineupReport(w, r)
+	if !ok {
+		return
+	}
+	serveJson(w, rep)
+}
+
+func (s *server) LineupStations(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.lineup == nil {
+		http.Error(w, "no lineup configured", http.StatusNotFound)
+		return
+	}
+	stations, err := s.lineup.Stations(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveJson(w, stations)
+}
+
+// PutLineupStation adds or replaces the station for the stream id in the path from a json body.
+func (s *server) PutLineupStation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.lineup == nil {
+		http.Error(w, "no lineup configured", http.StatusNotFound)
+		return
+	}
+	st := &Station{}
+	if err := json.NewDecoder(r.Body).Decode(st); err != nil {
+		http.Error(w, "could not read station: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := ps.ByName("id")
+	if st.StreamID != "" && st.StreamID != id {
+		http.Error(w, fmt.Sprintf("streamId %s does not match %s", st.StreamID, id), http.StatusBadRequest)
+		return
+	}
+	st.StreamID = id
+	if st.CallSign == "" {
+		st.CallSign = strings.SplitN(id, "-", 2)[0]
+	}
+	if err := st.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.lineup.Put(r.Context(), st); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveJson(w, st)
+}
+
+func (s *server) DeleteLineupStation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.lineup == nil {
+		http.Error(w, "no lineup configured", http.StatusNotFound)
+		return
+	}
+	if err := s.lineup.Delete(r.Context(), ps.ByName("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lineupServer(t *testing.T) (*server, func()) {
+	dir, err := ioutil.TempDir("", "lineup")
+	assert.Nil(t, err)
+	b, err := ioutil.ReadFile("fixtures/lineup.json")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "lineup.json")
+	assert.Nil(t, ioutil.WriteFile(path, b, 0644))
+	s := testServer(t)
+	s.lineup = newFileLineup(path)
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func send(s *server, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestLineupReport(t *testing.T) {
+	s, cleanup := lineupServer(t)
+	defer cleanup()
+
+	w := get(s, "/api/lineup")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var rep LineupReport
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &rep))
+	assert.Len(t, rep.Stations, 7)
+	var got []string
+	for _, p := range rep.Problems {
+		got = append(got, p.StreamID+" "+p.Problem)
+	}
+	assert.Equal(t, []string{
+		"KEEE-1005 " + lineupWrongType,
+		"KHHH-1008 " + lineupMissing,
+		"WDDD-1004 " + lineupNoBackup,
+		"WGGG-1007 " + lineupUnexpected,
+	}, got)
+	assert.Equal(t, "1080p", rep.Problems[0].HostType)
+	assert.Equal(t, "720p", rep.Problems[0].Expected)
+	assert.True(t, rep.Problems[2].Inferred)
+
+	w = get(s, "/lineup")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "KHHH-1008")
+}
+
+func TestLineupEdits(t *testing.T) {
+	s, cleanup := lineupServer(t)
+	defer cleanup()
+
+	w := send(s, "PUT", "/api/lineup/stations/WGGG-1007", `{"hostType": "1080p"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"callSign":"WGGG"`)
+	assert.Equal(t, http.StatusNoContent, send(s, "DELETE", "/api/lineup/stations/KHHH-1008", "").Code)
+
+	var stations []*Station
+	assert.Nil(t, json.Unmarshal(get(s, "/api/lineup/stations").Body.Bytes(), &stations))
+	assert.Len(t, stations, 7)
+	var rep LineupReport
+	assert.Nil(t, json.Unmarshal(get(s, "/api/lineup").Body.Bytes(), &rep))
+	assert.Len(t, rep.Problems, 2)
+
+	assert.Equal(t, http.StatusBadRequest, send(s, "PUT", "/api/lineup/stations/X-1", `{"streamId": "Y-1"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send(s, "PUT", "/api/lineup/stations/X-1", `{"redundancy": 3}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send(s, "PUT", "/api/lineup/stations/X-1", `{`).Code)
+
+	s.lineup = nil
+	assert.Equal(t, http.StatusNotFound, get(s, "/api/lineup").Code)
+}
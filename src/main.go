@@ -1,171 +1,331 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
-	"strings"
+	"os"
 	"time"
 
-	"github.com/Syncbak-Git/controldb"
 	"github.com/Syncbak-Git/jsconfig"
 	"github.com/Syncbak-Git/log"
 	"github.com/julienschmidt/httprouter"
 )
 
 type HomeDisplay struct {
-	Catchers  map[string][]string
-	Redirects []*Redirect
-	Title     string
+	Catchers    []*Catcher
+	Adapters    []*Adapter
+	Transcoders []*Transcoder
+	Redirects   []*RedirectHost
+	// SplitStreams are streams logged by more than one adapter.
+	SplitStreams []*SplitStream
+	Title        string
+	// Window is the range the log derived data covers. Since, From and To echo the query for the picker.
+	Window window
+	Since  string
+	From   string
+	To     string
+	// Degraded lists the backends whose data is missing from the page.
+	Degraded []*Degradation
+	Breakers []*BreakerStatus
+	// Placement lists streams whose primary and backup could fail together.
+	Placement []*PlacementWarning
+	// Flapping lists streams that keep changing catcher, adapter or active host.
+	Flapping []*FlappingStream
+	// Anomalies lists the stream and slot counts outside their usual range.
+	Anomalies []*MetricStatus
+	// Market and Network filter the streams by their catalog entry and Group groups the catalog by
+	// "market" or "network". Markets and Networks are the picker choices, empty without a catalog.
+	Market   string
+	Network  string
+	Group    string
+	Markets  []string
+	Networks []string
+	Groups   []*StationGroup
+	// Maintenance is the maintenance windows in effect.
+	Maintenance maintenanceSet
+	// Notes is every operator annotation, newest first.
+	Notes annotations
+	// Offline holds the stations in a scheduled blackout keyed by stream id.
+	Offline map[string]*Offline
 }
 
-var maxCatcher int
-var maxAdapter int
+// NotesOn returns the annotations on any of a host's or stream's names.
+func (hd *HomeDisplay) NotesOn(names ...string) annotations {
+	return hd.Notes.on(names...)
+}
+
+// InMaintenance returns the maintenance window covering any of a host's names, or nil.
+func (hd *HomeDisplay) InMaintenance(names ...string) *Maintenance {
+	return hd.Maintenance.find(names...)
+}
+
+func (hd *HomeDisplay) setWindow(r *http.Request, w window) {
+	q := r.URL.Query()
+	hd.Window, hd.Since, hd.From, hd.To = w, q.Get("since"), q.Get("from"), q.Get("to")
+}
 
 func main() {
+	err := jsconfig.InitFromFiles(jsconfig.FilesFromEnv()...)
+	if err != nil {
+		log.Fatal("could not read config %s", err)
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:], jsconfig.S))
+	}
+	srv, err := newServer(jsconfig.S)
+	if err != nil {
+		log.Fatal("could not start server %s", err)
+	}
+	if interval := jsconfig.S.FindDuration("ConsistencyInterval"); interval > 0 {
+		go srv.runReconciler(context.Background(), interval)
+	}
+	if interval := jsconfig.S.FindDuration("SnapshotInterval"); interval > 0 && srv.tracker != nil {
+		go srv.runTracker(context.Background(), interval)
+	}
+	if interval := jsconfig.S.FindDuration("SampleInterval"); interval > 0 && srv.anomalies != nil {
+		go srv.runSampler(context.Background(), interval)
+	}
+	port := jsconfig.S.FindString("Port")
+	log.Info("listening on %s", port)
+	log.Fatal("%s", http.ListenAndServe(port, srv.routes()))
+}
 
+func (s *server) Home(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.page(w, r, "Catchers", partCatchers, partRedirects)
 }
 
-func Home(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	ids, err := getCatchers()
-	ids.Title = "Catchers"
+var templates = template.Must(template.New("index.html").Funcs(template.FuncMap{"short": shortHost}).ParseFiles(
+	"views/index.html",
+	"views/consistency.html",
+	"views/rebalance.html",
+	"views/simulate.html",
+	"views/events.html",
+	"views/diff.html",
+	"views/lineup.html",
+	"views/audit.html",
+))
+
+// page fetches parts and renders whatever succeeded. A page whose every backend failed is served as
+// 503 so monitors notice, but it still shows why.
+func (s *server) page(w http.ResponseWriter, r *http.Request, title string, parts ...part) {
+	hd, err := s.fetch(r, parts...)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if len(ids.Catchers) == 0 {
-		http.Error(w, "No ids in redis db", http.StatusInternalServerError)
-		return
+	hd.Title = title
+	hd.Breakers = s.breakerStatus()
+	hd.Maintenance = s.maintenance(r.Context(), time.Now())
+	hd.Notes = s.annotations(r.Context())
+	hd.Offline = s.offline(r.Context(), time.Now())
+	if s.anomalies != nil {
+		hd.Anomalies = s.anomalies.anomalous()
+	}
+	if len(hd.Catchers) > 0 {
+		hd.Placement = checkPlacement(hd.Catchers)
 	}
-	for k := range ids.Catchers {
-		v := ids.Catchers[k]
-		for i := range v {
-			v[i] = strings.Replace(v[i], ".syncbak.corp", "", 1)
+	for _, p := range parts {
+		if p == partCatchers || p == partAdapters {
+			hd.Flapping = s.pageFlapping(time.Now())
+			s.pageStations(r, hd)
+			break
 		}
 	}
-	err = templates.Execute(w, ids)
-
+	for _, d := range hd.Degraded {
+		log.Warning("%s %s", r.URL.Path, d)
+	}
+	if len(hd.Degraded) == len(parts) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err = templates.Execute(w, hd)
 	if err != nil {
 		log.Error("error executing template %s\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-var templates = template.Must(template.ParseFiles("views/index.html"))
-
-func db() *controldb.SourceStreamDb {
-	time := time.Duration(4 * time.Second)
-	redisdb := jsconfig.S.FindString("Redis")
-	redispw := jsconfig.S.FindString("RedisPwd")
-	return controldb.NewSourceStreamDb(redisdb, redispw, time)
+// pageStations groups and filters the catcher and adapter pages by the catalog. Placement is checked
+// before filtering since a backup may be on a host the filter drops.
+func (s *server) pageStations(r *http.Request, hd *HomeDisplay) {
+	if s.catalog == nil {
+		return
+	}
+	q := r.URL.Query()
+	hd.Market, hd.Network, hd.Group = q.Get("market"), q.Get("network"), q.Get("group")
+	infos := s.catalog.all()
+	hd.Markets, hd.Networks = catalogValues(infos)
+	f := stationFilter{market: hd.Market, network: hd.Network}
+	if hd.Group == "market" || hd.Group == "network" {
+		var matched []*StationInfo
+		for _, info := range infos {
+			if f.match(info) {
+				matched = append(matched, info)
+			}
+		}
+		hd.Groups = groupStations(matched, hd.Group, hd)
+	}
+	f.apply(hd)
 }
 
-func getCatchers() (*HomeDisplay, error) {
-	db := db()
-	if db == nil {
-		return nil, fmt.Errorf("Could not get db it is nil %+v", db)
+// one fetches a single backend for the plain text and json endpoints, which fail outright without it.
+func (s *server) one(w http.ResponseWriter, r *http.Request, p part) (*HomeDisplay, bool) {
+	hd, err := s.fetch(r, p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
 	}
-
-	assigned, err := db.FetchAllCatchers()
-	check(err)
-
-	rd := newRedirectDb(jsconfig.S.FindString("Redis"), jsconfig.S.FindString("RedisPwd"), jsconfig.S.FindString("RedirectPrefix"))
-	rds, err := rd.streams()
-	check(err)
-
-	return &HomeDisplay{Catchers: assigned, Redirects: rds}, nil
+	if len(hd.Degraded) > 0 {
+		http.Error(w, hd.Degraded[0].String(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return hd, true
 }
 
-func writeAdapterInfo(w http.ResponseWriter, r *http.Request, write func(http.ResponseWriter, map[string][]string)) {
-	ids, err := adapterAssignments()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (s *server) writeAdapterInfo(w http.ResponseWriter, r *http.Request, write func(http.ResponseWriter, []*Adapter)) {
+	hd, ok := s.one(w, r, partAdapters)
+	if !ok {
 		return
 	}
-	if len(ids) == 0 {
-		http.Error(w, "No adapters in rabbitmq", http.StatusInternalServerError)
+	if len(hd.Adapters) == 0 {
+		http.Error(w, "No adapters found", http.StatusInternalServerError)
 		return
 	}
-	write(w, ids)
+	write(w, hd.Adapters)
 }
 
-func AdapterCount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	writeAdapterInfo(w, r, func(newWriter http.ResponseWriter, vals map[string][]string) {
+func (s *server) AdapterCount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.writeAdapterInfo(w, r, func(newWriter http.ResponseWriter, vals []*Adapter) {
 		fmt.Fprintf(w, "%d", len(vals))
 	})
 }
 
-func AdapterSlots(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	writeAdapterInfo(w, r, func(newWriter http.ResponseWriter, vals map[string][]string) {
-		fmt.Fprintf(w, "%d", len(vals)*maxAdapter)
+func (s *server) AdapterSlots(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.writeAdapterInfo(w, r, func(newWriter http.ResponseWriter, vals []*Adapter) {
+		fmt.Fprintf(w, "%d", s.limits(r.Context()).adapterSlots(vals))
 	})
 }
 
-func AdapterSlotsUsed(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	writeAdapterInfo(w, r, func(newWriter http.ResponseWriter, vals map[string][]string) {
+func (s *server) AdapterSlotsUsed(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.writeAdapterInfo(w, r, func(newWriter http.ResponseWriter, vals []*Adapter) {
 		count := 0
-		for _, streams := range vals {
-			count += len(streams)
+		for _, a := range vals {
+			count += len(a.Streams)
 		}
 		fmt.Fprintf(w, "%d", count)
 	})
 }
 
-func Adapters(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	writeAdapterInfo(w, r, func(newWriter http.ResponseWriter, vals map[string][]string) {
-		hd := &HomeDisplay{Catchers: vals, Title: "CDN Adapters"}
-		err := templates.Execute(w, hd)
-		if err != nil {
-			log.Error("error executing templates %s\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+func (s *server) Adapters(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.page(w, r, "CDN Adapters", partAdapters)
+}
+
+func (s *server) AdaptersJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.writeAdapterInfo(w, r, func(newWriter http.ResponseWriter, vals []*Adapter) {
+		serveJson(w, vals)
 	})
 }
 
-func Transcoders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	t, err := connectedTranscoders()
-	if err != nil {
-		log.Error("error executing template %s\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-	hd := &HomeDisplay{Catchers: t, Title: "Transcoders"}
-	err = templates.Execute(w, hd)
-	if err != nil {
-		log.Error("error executing template %s\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (s *server) SplitStreams(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.writeAdapterInfo(w, r, func(newWriter http.ResponseWriter, vals []*Adapter) {
+		serveJson(w, splitStreams(vals))
+	})
+}
+
+func (s *server) Transcoders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.page(w, r, "Transcoders", partTranscoders)
+}
+
+func (s *server) TranscodersJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	hd, ok := s.one(w, r, partTranscoders)
+	if !ok {
+		return
 	}
+	serveJson(w, hd.Transcoders)
 }
 
-func writeCatcherStat(w http.ResponseWriter, r *http.Request, isSlots bool) {
-	ids, err := getCatchers()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (s *server) writeCatcherStat(w http.ResponseWriter, r *http.Request, isSlots bool) {
+	ids, ok := s.one(w, r, partCatchers)
+	if !ok {
 		return
 	}
 	if len(ids.Catchers) == 0 {
 		http.Error(w, "No ids in redis db", http.StatusInternalServerError)
+		return
 	}
 	val := len(ids.Catchers)
 	if isSlots {
-		val = val * maxCatcher
+		val = s.limits(r.Context()).catcherSlots(ids.Catchers)
 	}
 	fmt.Fprintf(w, "%d", val)
 }
 
-func Catchers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	db := db()
-	if db == nil {
-		log.Error("could not get database! it is nil")
-		http.Error(w, "db is nil", http.StatusInternalServerError)
+func (s *server) CatcherCount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.writeCatcherStat(w, r, false)
+}
+
+func (s *server) CatcherSlots(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.writeCatcherStat(w, r, true)
+}
+
+func (s *server) Catchers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	hd, ok := s.one(w, r, partCatchers)
+	if !ok {
 		return
 	}
-	slots, err := db.FetchAllCatchers()
+	serveJson(w, hd.Catchers)
+}
+
+func (s *server) ActiveStreams(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tw, ok := s.window(w, r, s.transcoderWindow)
+	if !ok {
+		return
+	}
+	var count int
+	err := s.call(r.Context(), partTranscoders, func(ctx context.Context) (err error) {
+		count, err = s.transcoders.ActiveStreamCount(ctx, tw)
+		return err
+	})
 	if err != nil {
-		http.Error(w, "Could not fetch catchers error:"+err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%d", count)
+}
+
+func (s *server) WorkersInUse(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tw, ok := s.window(w, r, s.transcoderWindow)
+	if !ok {
 		return
 	}
-	serveJson(w, slots)
+	var workers float64
+	err := s.call(r.Context(), partTranscoders, func(ctx context.Context) (err error) {
+		workers, err = s.transcoders.WorkersInUse(ctx, tw)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%g", workers)
+}
+
+// Health reports the state of every backend's circuit breaker. The status is "degraded" while any
+// breaker is not closed.
+func (s *server) Health(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	breakers := s.breakerStatus()
+	status := "ok"
+	for _, b := range breakers {
+		if b.State != breakerClosed.String() {
+			status = "degraded"
+		}
+	}
+	serveJson(w, struct {
+		Status   string           `json:"status"`
+		Breakers []*BreakerStatus `json:"breakers"`
+	}{status, breakers})
 }
 
 func serveJson(w http.ResponseWriter, obj interface{}) {
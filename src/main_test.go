@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testServer(t *testing.T) *server {
+	f, err := loadFixture("fixtures/demo.json")
+	assert.Nil(t, err, "%s", err)
+	return &server{catchers: f, adapters: f, transcoders: f, redirects: f, maxCatcher: 9, maxAdapter: 9,
+		consistency: newReconciler()}
+}
+
+func get(s *server, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestCounts(t *testing.T) {
+	s := testServer(t)
+	cases := map[string]string{
+		"/catchers/count":      "3",
+		"/catchers/slots":      "27",
+		"/adapters/count":      "2",
+		"/adapters/slots":      "18",
+		"/adapters/slotsused":  "6",
+		"/transcoders/streams": "6",
+		"/transcoders/workers": "6",
+	}
+	for path, want := range cases {
+		w := get(s, path)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, want, w.Body.String(), path)
+	}
+}
+
+func TestPages(t *testing.T) {
+	s := testServer(t)
+	cases := map[string]string{
+		"/":            "catcher03",
+		"/adapters":    "10.10.2.12",
+		"/transcoders": "segment 4412 arrived late",
+	}
+	for path, want := range cases {
+		w := get(s, path)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Contains(t, w.Body.String(), want, path)
+	}
+	assert.Contains(t, get(s, "/").Body.String(), "redirect01")
+}
+
+func TestCatchersJSON(t *testing.T) {
+	w := get(testServer(t), "/api/catchers")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var catchers []*Catcher
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &catchers))
+	assert.Len(t, catchers, 3)
+	assert.Equal(t, "catcher01.syncbak.corp", catchers[0].Hostname)
+	assert.Equal(t, "KBBB-1002", catchers[0].Streams[1].ID)
+}
+
+func TestBackendErrors(t *testing.T) {
+	s := testServer(t)
+	down := failing{err: errors.New("backend down")}
+	s.catchers, s.adapters, s.transcoders = down, down, down
+	for _, path := range []string{"/catchers/count", "/api/catchers", "/adapters/count", "/api/adapters", "/api/transcoders"} {
+		w := get(s, path)
+		assert.Equal(t, http.StatusInternalServerError, w.Code, path)
+		assert.Contains(t, w.Body.String(), "backend down", path)
+	}
+	for _, path := range []string{"/adapters", "/transcoders"} {
+		w := get(s, path)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, path)
+		assert.Contains(t, w.Body.String(), "data unavailable (backend down)", path)
+	}
+}
+
+func TestPartialPage(t *testing.T) {
+	s := testServer(t)
+	s.catchers = failing{err: errors.New("backend down")}
+	w := get(s, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "degraded: catcher data unavailable (backend down)")
+	assert.Contains(t, w.Body.String(), "redirect01")
+}
+
+// slowCatchers answers after delay unless its context ends first, which it reports on cancelled. It
+// counts its calls in calls when set.
+type slowCatchers struct {
+	delay     time.Duration
+	cancelled chan error
+	calls     *int32
+}
+
+func (s slowCatchers) Catchers(ctx context.Context) ([]*Catcher, error) {
+	if s.calls != nil {
+		atomic.AddInt32(s.calls, 1)
+	}
+	select {
+	case <-time.After(s.delay):
+		return []*Catcher{{IP: "10.0.0.1"}}, nil
+	case <-ctx.Done():
+		if s.cancelled != nil {
+			s.cancelled <- ctx.Err()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func TestSourceTimeout(t *testing.T) {
+	s := testServer(t)
+	cancelled := make(chan error, 1)
+	s.catchers = slowCatchers{delay: time.Minute, cancelled: cancelled}
+	s.catcherTimeout = 20 * time.Millisecond
+	w := get(s, "/")
+	select {
+	case err := <-cancelled:
+		assert.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("source was not cancelled")
+	}
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "degraded: catcher data unavailable (timeout after 20ms)")
+	assert.Contains(t, w.Body.String(), "redirect01")
+}
+
+func TestTimeoutCancelsSource(t *testing.T) {
+	s := testServer(t)
+	cancelled := make(chan error, 1)
+	s.catchers = slowCatchers{delay: time.Minute, cancelled: cancelled}
+	s.catcherTimeout = 10 * time.Millisecond
+	get(s, "/api/catchers")
+	select {
+	case err := <-cancelled:
+		assert.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(time.Second):
+		t.Fatal("source was not cancelled")
+	}
+}
+
+func TestClientGoneCancelsSource(t *testing.T) {
+	s := testServer(t)
+	cancelled := make(chan error, 1)
+	s.catchers = slowCatchers{delay: time.Minute, cancelled: cancelled}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/catchers", nil).WithContext(ctx))
+	}()
+	cancel()
+	select {
+	case err := <-cancelled:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("source was not cancelled")
+	}
+}
+
+func TestClientGoneLeavesBreakerClosed(t *testing.T) {
+	s := testServer(t)
+	s.catchers = slowCatchers{delay: time.Minute}
+	s.breakers = map[part]*breaker{partCatchers: newBreaker("catcher", 2, time.Minute)}
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(5*time.Millisecond, cancel)
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/catchers", nil).WithContext(ctx))
+	}
+	st := s.breakers[partCatchers].status()
+	assert.Equal(t, "closed", st.State)
+	assert.Equal(t, 0, st.Failures)
+}
+
+func TestEmptyBackends(t *testing.T) {
+	s := testServer(t)
+	s.catchers, s.adapters = &fixture{}, &fixture{}
+	assert.Contains(t, get(s, "/").Body.String(), "No catchers in the nameservice")
+	assert.Equal(t, http.StatusInternalServerError, get(s, "/catchers/count").Code)
+	assert.Equal(t, http.StatusInternalServerError, get(s, "/adapters/count").Code)
+}
+
+func TestWindowQuery(t *testing.T) {
+	s := testServer(t)
+	for _, path := range []string{"/", "/adapters", "/transcoders"} {
+		assert.Equal(t, http.StatusBadRequest, get(s, path+"?since=never").Code, path)
+		w := get(s, path+"?since=1h")
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Contains(t, w.Body.String(), `<option value="1h" selected>`, path)
+	}
+}
+
+func TestBreakerOpensOnTimeouts(t *testing.T) {
+	s := testServer(t)
+	var calls int32
+	s.catchers = slowCatchers{delay: time.Minute, calls: &calls}
+	s.catcherTimeout = 10 * time.Millisecond
+	s.breakers = map[part]*breaker{partCatchers: newBreaker("catcher", 2, time.Minute)}
+
+	get(s, "/")
+	get(s, "/")
+	w := get(s, "/")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "an open breaker does not call the source")
+	assert.Contains(t, w.Body.String(), "catcher data unavailable (circuit open after 2 failures")
+
+	var health struct {
+		Status   string
+		Breakers []*BreakerStatus
+	}
+	assert.Nil(t, json.Unmarshal(get(s, "/health").Body.Bytes(), &health))
+	assert.Equal(t, "degraded", health.Status)
+	assert.Equal(t, "open", health.Breakers[0].State)
+	assert.Equal(t, "timeout after 10ms", health.Breakers[0].LastError)
+}
+
+func TestFixtureConcurrentPages(t *testing.T) {
+	s := testServer(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, path := range []string{"/", "/adapters", "/transcoders"} {
+				assert.Equal(t, http.StatusOK, get(s, path).Code, path)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/garyburd/redigo/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Maintenance is a declared maintenance window for a catcher, adapter, transcoder or redirect host.
+type Maintenance struct {
+	ID string `json:"id"`
+	// Host is a host name, short host name or ip.
+	Host   string    `json:"host"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason,omitempty"`
+	Owner  string    `json:"owner,omitempty"`
+	// ExcludeCapacity leaves the host out of capacity totals for the window.
+	ExcludeCapacity bool `json:"excludeCapacity,omitempty"`
+}
+
+func (m *Maintenance) validate() error {
+	if m.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if m.Start.IsZero() || m.End.IsZero() {
+		return fmt.Errorf("start and end are required")
+	}
+	if !m.End.After(m.Start) {
+		return fmt.Errorf("end %s is not after start %s", m.End.Format(time.RFC3339), m.Start.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (m *Maintenance) activeAt(t time.Time) bool {
+	return !t.Before(m.Start) && t.Before(m.End)
+}
+
+// matches reports whether the window is for any of names. Host names also match by short name.
+func (m *Maintenance) matches(names ...string) bool {
+	for _, n := range names {
+		if n == "" {
+			continue
+		}
+		if n == m.Host || (net.ParseIP(n) == nil && shortHost(n) == shortHost(m.Host)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Maintenance) String() string {
+	s := "in maintenance until " + m.End.Format("Jan 2 15:04 MST")
+	if m.Owner != "" {
+		s += " by " + m.Owner
+	}
+	if m.Reason != "" {
+		s += ": " + m.Reason
+	}
+	return s
+}
+
+// maintenanceSet is the maintenance windows in effect at some time.
+type maintenanceSet []*Maintenance
+
+// find returns the window covering any of a host's names, or nil.
+func (ms maintenanceSet) find(names ...string) *Maintenance {
+	for _, m := range ms {
+		if m.matches(names...) {
+			return m
+		}
+	}
+	return nil
+}
+
+// keepEnded is how long a store keeps windows after they end, for looking back at recent work.
+const keepEnded = 30 * 24 * time.Hour
+
+// expired returns the ids of windows that ended more than keepEnded before now.
+func expired(ms []*Maintenance, now time.Time) []interface{} {
+	var ids []interface{}
+	for _, m := range ms {
+		if m.End.Before(now.Add(-keepEnded)) {
+			ids = append(ids, m.ID)
+		}
+	}
+	return ids
+}
+
+// maintenanceStore holds maintenance windows keyed by id. Putting a window drops those that ended more
+// than keepEnded ago.
+type maintenanceStore interface {
+	Windows(ctx context.Context) ([]*Maintenance, error)
+	Put(ctx context.Context, m *Maintenance) error
+	Delete(ctx context.Context, id string) error
+}
+
+func sortWindows(ms []*Maintenance) {
+	sort.Slice(ms, func(i, j int) bool {
+		if !ms[i].Start.Equal(ms[j].Start) {
+			return ms[i].Start.Before(ms[j].Start)
+		}
+		return ms[i].ID < ms[j].ID
+	})
+}
+
+// memMaintenance keeps windows in memory. It serves demo mode, where there is no redis to share.
+type memMaintenance struct {
+	mu      sync.Mutex
+	windows map[string]*Maintenance
+}
+
+func newMemMaintenance() *memMaintenance {
+	return &memMaintenance{windows: make(map[string]*Maintenance)}
+}
+
+func (mm *memMaintenance) Windows(_ context.Context) ([]*Maintenance, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	ms := []*Maintenance{}
+	for _, m := range mm.windows {
+		ms = append(ms, m)
+	}
+	sortWindows(ms)
+	return ms, nil
+}
+
+func (mm *memMaintenance) Put(_ context.Context, m *Maintenance) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.windows[m.ID] = m
+	for id, w := range mm.windows {
+		if w.End.Before(time.Now().Add(-keepEnded)) {
+			delete(mm.windows, id)
+		}
+	}
+	return nil
+}
+
+func (mm *memMaintenance) Delete(_ context.Context, id string) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	delete(mm.windows, id)
+	return nil
+}
+
+// redisMaintenance keeps windows in a redis hash of id to window json so every instance sees them.
+type redisMaintenance struct {
+	redisServer
+	key string
+}
+
+func newRedisMaintenance(rs redisServer, key string) *redisMaintenance {
+	return &redisMaintenance{redisServer: rs, key: key}
+}
+
+func (db *redisMaintenance) Windows(ctx context.Context) ([]*Maintenance, error) {
+	vals, err := redis.StringMap(db.do(ctx, "HGETALL", db.key))
+	if err != nil {
+		return nil, err
+	}
+	ms := []*Maintenance{}
+	for id, val := range vals {
+		m := &Maintenance{}
+		if err := json.Unmarshal([]byte(val), m); err != nil {
+			log.Error("skipping bad maintenance window %s %q in %s: %s", id, val, db.key, err)
+			continue
+		}
+		m.ID = id
+		ms = append(ms, m)
+	}
+	sortWindows(ms)
+	return ms, nil
+}
+
+func (db *redisMaintenance) Put(ctx context.Context, m *Maintenance) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err = db.do(ctx, "HSET", db.key, m.ID, b); err != nil {
+		return err
+	}
+	ms, err := db.Windows(ctx)
+	if err != nil {
+		return err
+	}
+	if ids := expired(ms, time.Now()); len(ids) > 0 {
+		_, err = db.do(ctx, "HDEL", append([]interface{}{db.key}, ids...)...)
+	}
+	return err
+}
+
+func (db *redisMaintenance) Delete(ctx context.Context, id string) error {
+	_, err := db.do(ctx, "HDEL", db.key, id)
+	return err
+}
+
+// maintenance returns the windows in effect at now. Without a store, or if it cannot be read, there
+// are none.
+func (s *server) maintenance(ctx context.Context, now time.Time) maintenanceSet {
+	if s.maint == nil {
+		return nil
+	}
+	ms, err := s.maint.Windows(ctx)
+	if err != nil {
+		log.Error("could not read maintenance windows %s", err)
+		return nil
+	}
+	var active maintenanceSet
+	for _, m := range ms {
+		if m.activeAt(now) {
+			active = append(active, m)
+		}
+	}
+	return active
+}
+
+// MaintenanceJSON lists every maintenance window, past, current and planned.
+func (s *server) MaintenanceJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.maint == nil {
+		http.Error(w, "no maintenance store configured", http.StatusNotFound)
+		return
+	}
+	ms, err := s.maint.Windows(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveJson(w, ms)
+}
+
+// AddMaintenance declares a maintenance window from a json body. The id is made up from the host and
+// start when the body has none.
+func (s *server) AddMaintenance(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.maint == nil {
+		http.Error(w, "no maintenance store configured", http.StatusNotFound)
+		return
+	}
+	m := &Maintenance{}
+	if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+		http.Error(w, "could not read maintenance window: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := m.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if m.ID == "" {
+		m.ID = fmt.Sprintf("%s-%d", shortHost(m.Host), m.Start.Unix())
+	}
+	if err := s.maint.Put(r.Context(), m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Info("maintenance %s for %s from %s to %s by %s", m.ID, m.Host, m.Start.Format(time.RFC3339), m.End.Format(time.RFC3339), m.Owner)
+	serveJson(w, m)
+}
+
+func (s *server) DeleteMaintenance(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.maint == nil {
+		http.Error(w, "no maintenance store configured", http.StatusNotFound)
+		return
+	}
+	if err := s.maint.Delete(r.Context(), ps.ByName("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
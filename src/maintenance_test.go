@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	start := time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC)
+	m := &Maintenance{Host: "catcher02.syncbak.corp", Start: start, End: start.Add(2 * time.Hour), Owner: "jlee", Reason: "kernel update"}
+	assert.Nil(t, m.validate())
+	assert.False(t, m.activeAt(start.Add(-time.Second)))
+	assert.True(t, m.activeAt(start))
+	assert.False(t, m.activeAt(start.Add(2*time.Hour)))
+	assert.True(t, m.matches("", "catcher02"))
+	assert.False(t, m.matches("catcher01.syncbak.corp", "10.10.1.12"))
+	assert.Equal(t, "in maintenance until Oct 18 04:00 UTC by jlee: kernel update", m.String())
+
+	ip := &Maintenance{Host: "10.10.2.1"}
+	assert.True(t, ip.matches("10.10.2.1"))
+	assert.False(t, ip.matches("10.10.2.11"))
+
+	for _, bad := range []*Maintenance{{Start: start, End: start.Add(time.Hour)}, {Host: "x"}, {Host: "x", Start: start, End: start}} {
+		assert.NotNil(t, bad.validate())
+	}
+}
+
+func maintenanceServer(t *testing.T) *server {
+	s := testServer(t)
+	s.maint = newMemMaintenance()
+	return s
+}
+
+func addWindow(t *testing.T, s *server, host string, exclude bool) *Maintenance {
+	now := time.Now()
+	b, err := json.Marshal(&Maintenance{Host: host, Start: now.Add(-time.Hour), End: now.Add(time.Hour), Reason: "rack move",
+		Owner: "ops", ExcludeCapacity: exclude})
+	assert.Nil(t, err)
+	w := send(s, "POST", "/api/maintenance", string(b))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	m := &Maintenance{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), m))
+	return m
+}
+
+func TestMaintenanceEndedDropped(t *testing.T) {
+	ctx := context.Background()
+	mm := newMemMaintenance()
+	now := time.Now()
+	old := &Maintenance{ID: "old", Host: "catcher01", Start: now.Add(-keepEnded - 2*time.Hour), End: now.Add(-keepEnded - time.Hour)}
+	recent := &Maintenance{ID: "recent", Host: "catcher01", Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour)}
+	assert.Equal(t, []interface{}{"old"}, expired([]*Maintenance{old, recent}, now))
+
+	assert.Nil(t, mm.Put(ctx, old))
+	assert.Nil(t, mm.Put(ctx, recent))
+	ms, err := mm.Windows(ctx)
+	assert.Nil(t, err)
+	if assert.Len(t, ms, 1) {
+		assert.Equal(t, "recent", ms[0].ID)
+	}
+}
+
+func TestMaintenanceAPI(t *testing.T) {
+	s := maintenanceServer(t)
+	m := addWindow(t, s, "catcher02.syncbak.corp", false)
+	assert.Equal(t, "catcher02-", m.ID[:len("catcher02-")])
+
+	var windows []*Maintenance
+	assert.Nil(t, json.Unmarshal(get(s, "/api/maintenance").Body.Bytes(), &windows))
+	assert.Len(t, windows, 1)
+
+	body := get(s, "/").Body.String()
+	assert.Contains(t, body, `<tr class="maintenance">`)
+	assert.Contains(t, body, "catcher02 (in maintenance until")
+	assert.Equal(t, "27", get(s, "/catchers/slots").Body.String(), "capacity is kept unless excluded")
+
+	addWindow(t, s, "10.10.2.12", true)
+	addWindow(t, s, "catcher01", true)
+	assert.Equal(t, "18", get(s, "/catchers/slots").Body.String())
+	assert.Equal(t, "9", get(s, "/adapters/slots").Body.String())
+	assert.Contains(t, get(s, "/rebalance").Body.String(), "catcher01 (in maintenance until")
+	assert.Contains(t, get(s, "/adapters").Body.String(), "10.10.2.12 (in maintenance until")
+
+	assert.Equal(t, http.StatusNoContent, send(s, "DELETE", "/api/maintenance/"+m.ID, "").Code)
+	windows = nil
+	assert.Nil(t, json.Unmarshal(get(s, "/api/maintenance").Body.Bytes(), &windows))
+	assert.Len(t, windows, 2)
+
+	assert.Equal(t, http.StatusBadRequest, send(s, "POST", "/api/maintenance", `{"host": "catcher01"}`).Code)
+	assert.Equal(t, http.StatusNotFound, get(testServer(t), "/api/maintenance").Code)
+}
+
+func TestMaintenanceSuppresses(t *testing.T) {
+	s := maintenanceServer(t)
+	n := &recordingNotifier{}
+	s.alerts = &alerter{notifiers: []notifier{n}, maintenance: s.maintenance}
+	addWindow(t, s, "10.10.1.21", false)
+
+	var rep ConsistencyReport
+	assert.Nil(t, json.Unmarshal(get(s, "/api/consistency").Body.Bytes(), &rep))
+	assert.Empty(t, rep.Inconsistencies)
+	if assert.Len(t, rep.Suppressed, 1) {
+		assert.Equal(t, "WGGG-1007", rep.Suppressed[0].StreamID)
+		assert.Contains(t, rep.Suppressed[0].Ignored, "10.10.1.21 in maintenance until")
+	}
+	var suite junitSuite
+	assert.Nil(t, xml.Unmarshal(get(s, "/api/consistency.xml").Body.Bytes(), &suite))
+	assert.Equal(t, 1, suite.Skipped)
+	s.reconcile(context.Background())
+	assert.Empty(t, n.alerts)
+
+	now := time.Now()
+	s.alerts.send(context.Background(), &Alert{Time: now, Hosts: []string{"catcher03.syncbak.corp", "10.10.1.21"}})
+	assert.Empty(t, n.alerts)
+	s.alerts.send(context.Background(), &Alert{Time: now, Hosts: []string{"10.10.1.11"}})
+	s.alerts.send(context.Background(), &Alert{Time: now.Add(2 * time.Hour), Hosts: []string{"10.10.1.21"}})
+	assert.Len(t, n.alerts, 2)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// SourceStream is a single station feed as seen by one stage of the pipeline.
+type SourceStream struct {
+	ID         string    `json:"id"`
+	ActiveHost string    `json:"activeHost,omitempty"`
+	LastSeen   time.Time `json:"lastSeen"`
+	// AlsoOn lists other hosts at the same stage that reported the stream in the same window.
+	AlsoOn []string `json:"alsoOn,omitempty"`
+	// Station is the stream's station catalog entry, nil when it has none.
+	Station *StationInfo `json:"station,omitempty"`
+}
+
+// Catcher is a segment ingest host and the source streams assigned to it in the nameservice.
+type Catcher struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	Type     string `json:"type"`
+	// Zone is the host's availability zone, empty until EC2 metadata is available.
+	Zone      string          `json:"zone,omitempty"`
+	Streams   []*SourceStream `json:"streams"`
+	FetchedAt time.Time       `json:"fetchedAt"`
+}
+
+// Adapter is a CDN adapter host and the source streams it has logged.
+type Adapter struct {
+	IP       string          `json:"ip"`
+	Streams  []*SourceStream `json:"streams"`
+	LastSeen time.Time       `json:"lastSeen"`
+}
+
+// Transcoder is a transcoder host seen in the logs.
+type Transcoder struct {
+	Host     string          `json:"host"`
+	LastSeen time.Time       `json:"lastSeen"`
+	Streams  []*SourceStream `json:"streams"`
+	// Workers is the number of worker threads the host logged from in the window, its share of
+	// transcoderWorkersInUse.
+	Workers int                `json:"workers"`
+	Errors  []*TranscoderError `json:"errors"`
+}
+
+// TranscoderError is an error level log entry from a transcoder.
+type TranscoderError struct {
+	Time     time.Time `json:"time"`
+	StreamID string    `json:"streamId,omitempty"`
+	Message  string    `json:"message"`
+}
+
+// RedirectHost is an entry in the redirect hash describing a redirect server's load.
+type RedirectHost struct {
+	Streams   int       `json:"streams"`
+	Max       int       `json:"max"`
+	Host      string    `json:"host"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Since returns the number of seconds since the redirect host last reported.
+func (r *RedirectHost) Since() int64 {
+	return int64(time.Since(r.Timestamp) / time.Second)
+}
+
+func sortStreams(streams []*SourceStream) {
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].ID < streams[j].ID
+	})
+}
+
+// shortHost drops the corporate domain from a host name for display.
+func shortHost(host string) string {
+	return strings.Replace(host, ".syncbak.corp", "", 1)
+}
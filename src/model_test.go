@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatcherJSONRoundTrip(t *testing.T) {
+	now := time.Date(2019, 11, 22, 16, 57, 24, 0, time.UTC)
+	c := &Catcher{
+		IP:       "10.0.0.1",
+		Hostname: "catcher:01 : a.syncbak.corp",
+		Type:     "720p",
+		Streams: []*SourceStream{
+			{ID: "KXYZ:1", ActiveHost: "catcher:01 : a.syncbak.corp", LastSeen: now},
+		},
+		FetchedAt: now,
+	}
+	b, err := json.Marshal(c)
+	assert.Nil(t, err, "%s", err)
+
+	var decoded Catcher
+	assert.Nil(t, json.Unmarshal(b, &decoded))
+	assert.Equal(t, c, &decoded)
+}
+
+func TestRedirectHostJSONKeys(t *testing.T) {
+	b, err := json.Marshal(&RedirectHost{Streams: 3, Max: 9, Host: "redirect01"})
+	assert.Nil(t, err, "%s", err)
+
+	var m map[string]interface{}
+	assert.Nil(t, json.Unmarshal(b, &m))
+	for _, k := range []string{"streams", "max", "host", "timestamp"} {
+		assert.Contains(t, m, k)
+	}
+}
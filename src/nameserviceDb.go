@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	streamKey     = "nameservice:stream:"
+	activeHostKey = "nameservice:activehost:"
+	hostLookupKey = "hostlookup:"
+	hostTypeKey   = "hosttype:"
+)
+
+// nameserviceDb reads catcher assignments from the nameservice keyspace.
+type nameserviceDb struct {
+	redisServer
+}
+
+func newNameserviceDb(rs redisServer) *nameserviceDb {
+	return &nameserviceDb{redisServer: rs}
+}
+
+// keyspace is the raw content of the nameservice keys. Missing keys are recorded as empty strings.
+type keyspace struct {
+	// streams maps source stream id to the ip of the catcher holding it.
+	streams map[string]string
+	// activeHosts maps source stream id to the host name currently serving it.
+	activeHosts map[string]string
+	// hostLookups maps catcher ip to host name.
+	hostLookups map[string]string
+	// hostTypes maps host name to host type, i.e. 720p.
+	hostTypes map[string]string
+}
+
+func (db *nameserviceDb) keyspace(ctx context.Context) (*keyspace, error) {
+	ks, err := db.readKeyspace(ctx)
+	return ks, ctxErr(ctx, err)
+}
+
+func (db *nameserviceDb) readKeyspace(ctx context.Context) (*keyspace, error) {
+	conn, err := db.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", streamKey+"*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	ks := &keyspace{
+		streams:     make(map[string]string),
+		activeHosts: make(map[string]string),
+		hostLookups: make(map[string]string),
+		hostTypes:   make(map[string]string),
+	}
+	if len(keys) == 0 {
+		return ks, nil
+	}
+
+	ips, err := multiGet(conn, keys)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = strings.TrimPrefix(key, streamKey)
+		ks.streams[ids[i]] = ips[i]
+	}
+	if err := getInto(conn, ks.activeHosts, activeHostKey, ids); err != nil {
+		return nil, err
+	}
+	if err := getInto(conn, ks.hostLookups, hostLookupKey, uniq(ips)); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range ks.hostLookups {
+		names = append(names, name)
+	}
+	if err := getInto(conn, ks.hostTypes, hostTypeKey, uniq(names)); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Catchers returns every catcher holding at least one source stream, sorted by ip.
+// Unlike controldb.FetchAllCatchers a missing hostlookup or hosttype is left empty rather than
+// being reported as "unknown", and nothing is joined into strings.
+func (db *nameserviceDb) Catchers(ctx context.Context) ([]*Catcher, error) {
+	ks, err := db.keyspace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ks.catchers(time.Now()), nil
+}
+
+func (ks *keyspace) catchers(now time.Time) []*Catcher {
+	byIP := make(map[string]*Catcher)
+	for id, ip := range ks.streams {
+		c, ok := byIP[ip]
+		if !ok {
+			name := ks.hostLookups[ip]
+			c = &Catcher{IP: ip, Hostname: name, Type: ks.hostTypes[name], FetchedAt: now}
+			byIP[ip] = c
+		}
+		c.Streams = append(c.Streams, &SourceStream{ID: id, ActiveHost: ks.activeHosts[id], LastSeen: now})
+	}
+
+	catchers := make([]*Catcher, 0, len(byIP))
+	for _, c := range byIP {
+		sortStreams(c.Streams)
+		catchers = append(catchers, c)
+	}
+	sort.Slice(catchers, func(i, j int) bool {
+		return catchers[i].IP < catchers[j].IP
+	})
+	return catchers
+}
+
+// multiGet fetches keys in a single transaction. Missing keys are returned as empty strings.
+func multiGet(conn redis.Conn, keys []string) ([]string, error) {
+	conn.Send("MULTI")
+	for _, key := range keys {
+		conn.Send("GET", key)
+	}
+	return redis.Strings(conn.Do("EXEC"))
+}
+
+// getInto fetches prefix+suffix for every suffix and stores the values in m keyed by suffix.
+func getInto(conn redis.Conn, m map[string]string, prefix string, suffixes []string) error {
+	keys := make([]string, len(suffixes))
+	for i, s := range suffixes {
+		keys[i] = prefix + s
+	}
+	vals, err := multiGet(conn, keys)
+	if err != nil {
+		return err
+	}
+	for i, s := range suffixes {
+		m[s] = vals[i]
+	}
+	return nil
+}
+
+func uniq(vals []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, v := range vals {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
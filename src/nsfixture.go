@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Syncbak-Git/jsconfig"
+	"github.com/garyburd/redigo/redis"
+)
+
+// runCommand runs one of the maintenance commands and returns the process exit code.
+func runCommand(name string, args []string, settings jsconfig.Settings) int {
+	switch name {
+	case "seed":
+		return seedCommand(args, settings)
+	case "validate":
+		return validateCommand(args, settings)
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q, expected seed or validate\n", name)
+	return 2
+}
+
+// seedCommand loads a fixture into a redis nameservice keyspace. It refuses to touch anything but a
+// local redis: the keys it writes are the ones the dashboard only changes through the audit journal.
+func seedCommand(args []string, settings jsconfig.Settings) int {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	addr := fs.String("redis", "localhost:6379", "redis address to seed")
+	pwd := fs.String("pwd", "", "redis password")
+	prefix := fs.String("prefix", settings.FindString("RedirectPrefix"), "redirect hash prefix")
+	path := fs.String("fixture", "./fixtures/demo.json", "fixture file with catchers and redirects")
+	flush := fs.Bool("flush", false, "delete existing nameservice and redirect keys first")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !isLocal(*addr) {
+		fmt.Fprintf(os.Stderr, "refusing to seed %s, only a local redis can be seeded\n", *addr)
+		return 2
+	}
+
+	f, err := loadFixture(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read fixture %s\n", err)
+		return 1
+	}
+	conn, err := redisServer{addr: *addr, pwd: *pwd, timeout: redisTimeout(settings)}.connect(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not connect to %s %s\n", *addr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	n, err := seedKeyspace(conn, f, *prefix, *flush, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not seed %s %s\n", *addr, err)
+		return 1
+	}
+	fmt.Printf("wrote %d keys to %s\n", n, *addr)
+	return 0
+}
+
+func isLocal(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return host == "localhost" || net.ParseIP(host).IsLoopback()
+}
+
+// seedKeyspace writes the catchers and redirects of f in one transaction and returns the number of
+// keys and hash fields written. Redirects without a timestamp are stamped with now so they show up
+// as live.
+func seedKeyspace(conn redis.Conn, f *fixture, prefix string, flush bool, now time.Time) (int, error) {
+	var stale []interface{}
+	if flush {
+		for _, pattern := range []string{streamKey, activeHostKey, hostLookupKey, hostTypeKey} {
+			keys, err := redis.Strings(conn.Do("KEYS", pattern+"*"))
+			if err != nil {
+				return 0, err
+			}
+			for _, k := range keys {
+				stale = append(stale, k)
+			}
+		}
+		stale = append(stale, redirectKey+prefix)
+	}
+
+	n := 0
+	conn.Send("MULTI")
+	if len(stale) > 0 {
+		conn.Send("DEL", stale...)
+	}
+	for _, c := range f.CatcherList {
+		conn.Send("SET", hostLookupKey+c.IP, c.Hostname)
+		conn.Send("SET", hostTypeKey+c.Hostname, c.Type)
+		n += 2
+		for _, s := range c.Streams {
+			conn.Send("SET", streamKey+s.ID, c.IP)
+			conn.Send("SET", activeHostKey+s.ID, s.ActiveHost)
+			n += 2
+		}
+	}
+	for _, r := range f.RedirectList {
+		if r.Timestamp.IsZero() {
+			r.Timestamp = now
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			conn.Do("DISCARD")
+			return 0, err
+		}
+		conn.Send("HSET", redirectKey+prefix, r.Host, b)
+		n++
+	}
+	_, err := conn.Do("EXEC")
+	return n, err
+}
+
+// violation is a nameservice key whose content does not match what the dashboard expects.
+type violation struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+}
+
+// validateCommand scans a keyspace and reports every violation. It exits non-zero if any are found.
+func validateCommand(args []string, settings jsconfig.Settings) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	addr := fs.String("redis", settings.FindString("Redis"), "redis address to validate")
+	pwd := fs.String("pwd", settings.FindString("RedisPwd"), "redis password")
+	prefix := fs.String("prefix", settings.FindString("RedirectPrefix"), "redirect hash prefix")
+	asJSON := fs.Bool("json", false, "write violations as json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx := context.Background()
+	rs := redisServer{addr: *addr, pwd: *pwd, timeout: redisTimeout(settings)}
+	ks, err := newNameserviceDb(rs).keyspace(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read nameservice keys %s\n", err)
+		return 1
+	}
+	redirects, err := newRedirectDb(rs, *prefix).entries(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read redirect hash %s\n", err)
+		return 1
+	}
+
+	vs := validateKeyspace(ks, redirectKey+*prefix, redirects)
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(vs)
+	} else {
+		for _, v := range vs {
+			fmt.Printf("%s: %s\n", v.Key, v.Problem)
+		}
+		fmt.Printf("%d streams, %d violations\n", len(ks.streams), len(vs))
+	}
+	if len(vs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// validateKeyspace checks every stream, catcher and redirect entry and returns the violations sorted by key.
+// A stream may be active on its catcher or, after a failover, on that catcher's partner as found by
+// partnerHosts; an active host that is neither, or that no hostlookup: entry names, is a violation.
+func validateKeyspace(ks *keyspace, redirectHash string, redirects map[string][]byte) []violation {
+	vs := []violation{}
+	known := make(map[string]bool)
+	for _, name := range ks.hostLookups {
+		if name != "" {
+			known[shortHost(name)] = true
+		}
+	}
+	partners := partnerHosts(ks.catchers(time.Now()))
+	for id, ip := range ks.streams {
+		if ip == "" {
+			vs = append(vs, violation{streamKey + id, "stream has no catcher ip"})
+			continue
+		}
+		if ks.hostLookups[ip] == "" {
+			vs = append(vs, violation{streamKey + id, fmt.Sprintf("points at %s which has no %s entry", ip, hostLookupKey)})
+		}
+		switch active := ks.activeHosts[id]; {
+		case active == "":
+			vs = append(vs, violation{activeHostKey + id, "stream has no active host"})
+		case !known[shortHost(active)]:
+			vs = append(vs, violation{activeHostKey + id, fmt.Sprintf("names %s which has no %s entry", active, hostLookupKey)})
+		case ks.hostLookups[ip] == "" || shortHost(active) == shortHost(ks.hostLookups[ip]):
+		case shortHost(active) != shortHost(partners[shortHost(ks.hostLookups[ip])]):
+			vs = append(vs, violation{activeHostKey + id, fmt.Sprintf("names %s which neither holds the stream nor pairs with %s", active, ks.hostLookups[ip])})
+		}
+	}
+	for ip, name := range ks.hostLookups {
+		if name != "" && ks.hostTypes[name] == "" {
+			vs = append(vs, violation{hostTypeKey + name, fmt.Sprintf("missing for %s (%s)", name, ip)})
+		}
+	}
+	for field, val := range redirects {
+		r := &RedirectHost{}
+		if err := json.Unmarshal(val, r); err != nil {
+			vs = append(vs, violation{redirectHash + " " + field, fmt.Sprintf("unparseable redirect %q: %s", string(val), err)})
+		}
+	}
+
+	sort.Slice(vs, func(i, j int) bool {
+		if vs[i].Key == vs[j].Key {
+			return vs[i].Problem < vs[j].Problem
+		}
+		return vs[i].Key < vs[j].Key
+	})
+	return vs
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func brokenKeyspace() *keyspace {
+	return &keyspace{
+		streams: map[string]string{
+			"KAAA-1001": "10.0.0.1",
+			"KBBB-1002": "10.0.0.2",
+			"KCCC-1003": "10.0.0.1",
+		},
+		activeHosts: map[string]string{
+			"KAAA-1001": "catcher01",
+			"KBBB-1002": "catcher01",
+			"KCCC-1003": "catcher09",
+		},
+		hostLookups: map[string]string{"10.0.0.1": "catcher01", "10.0.0.2": ""},
+		hostTypes:   map[string]string{"catcher01": ""},
+	}
+}
+
+func TestValidateKeyspace(t *testing.T) {
+	redirects := map[string][]byte{
+		"redirect01": []byte(`{"host":"redirect01","streams":1,"max":9}`),
+		"redirect02": []byte(`not json`),
+	}
+	vs := validateKeyspace(brokenKeyspace(), "ns:redirect:p6-qa", redirects)
+
+	var keys []string
+	for _, v := range vs {
+		keys = append(keys, v.Key)
+	}
+	assert.Equal(t, []string{
+		"hosttype:catcher01",
+		"nameservice:activehost:KCCC-1003",
+		"nameservice:stream:KBBB-1002",
+		"ns:redirect:p6-qa redirect02",
+	}, keys)
+}
+
+func TestValidateCleanKeyspace(t *testing.T) {
+	ks := brokenKeyspace()
+	ks.hostLookups["10.0.0.2"] = "catcher02"
+	ks.hostTypes = map[string]string{"catcher01": "720p", "catcher02": "720p"}
+	ks.activeHosts["KCCC-1003"] = "catcher02"
+	assert.Empty(t, validateKeyspace(ks, "ns:redirect:p6-qa", nil))
+}
+
+func TestValidateStrayActiveHost(t *testing.T) {
+	ks := brokenKeyspace()
+	ks.streams["KDDD-1004"] = "10.0.0.3"
+	ks.activeHosts["KCCC-1003"] = "catcher02"
+	ks.activeHosts["KDDD-1004"] = "catcher01"
+	for _, id := range []string{"KEEE-1005", "KFFF-1006"} {
+		ks.streams[id] = "10.0.0.3"
+		ks.activeHosts[id] = "catcher02"
+	}
+	ks.hostLookups["10.0.0.2"] = "catcher02"
+	ks.hostLookups["10.0.0.3"] = "catcher03"
+	ks.hostTypes = map[string]string{"catcher01": "720p", "catcher02": "720p", "catcher03": "720p"}
+	vs := validateKeyspace(ks, "ns:redirect:p6-qa", nil)
+	if assert.Len(t, vs, 1) {
+		assert.Equal(t, activeHostKey+"KDDD-1004", vs[0].Key, "catcher03 pairs with catcher02")
+	}
+}
+
+// seedConn applies the commands seedKeyspace sends to a keyspace.
+type seedConn struct {
+	redis.Conn
+	ks        *keyspace
+	redirects map[string][]byte
+	queued    [][]interface{}
+}
+
+func (c *seedConn) Send(cmd string, args ...interface{}) error {
+	c.queued = append(c.queued, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+func (c *seedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "EXEC" {
+		return nil, fmt.Errorf("unexpected %s", cmd)
+	}
+	for _, q := range c.queued {
+		switch q[0] {
+		case "SET":
+			key, val := q[1].(string), q[2].(string)
+			for prefix, m := range map[string]map[string]string{
+				streamKey: c.ks.streams, activeHostKey: c.ks.activeHosts, hostLookupKey: c.ks.hostLookups, hostTypeKey: c.ks.hostTypes,
+			} {
+				if strings.HasPrefix(key, prefix) {
+					m[strings.TrimPrefix(key, prefix)] = val
+				}
+			}
+		case "HSET":
+			c.redirects[q[2].(string)] = q[3].([]byte)
+		}
+	}
+	return []interface{}{}, nil
+}
+
+func TestSeededDemoValidates(t *testing.T) {
+	f, err := loadFixture("./fixtures/demo.json")
+	assert.Nil(t, err)
+	conn := &seedConn{
+		ks: &keyspace{streams: map[string]string{}, activeHosts: map[string]string{}, hostLookups: map[string]string{},
+			hostTypes: map[string]string{}},
+		redirects: map[string][]byte{},
+	}
+	_, err = seedKeyspace(conn, f, "p6-qa", false, time.Now())
+	assert.Nil(t, err)
+	assert.Len(t, conn.ks.streams, 7)
+	assert.Empty(t, validateKeyspace(conn.ks, "ns:redirect:p6-qa", conn.redirects))
+}
+
+func TestKeyspaceCatchers(t *testing.T) {
+	catchers := brokenKeyspace().catchers(time.Now())
+	assert.Len(t, catchers, 2)
+	assert.Equal(t, "catcher01", catchers[0].Hostname)
+	assert.Equal(t, "", catchers[0].Type)
+	assert.Equal(t, []string{"KAAA-1001", "KCCC-1003"}, []string{catchers[0].Streams[0].ID, catchers[0].Streams[1].ID})
+	assert.Equal(t, "catcher09", catchers[0].Streams[1].ActiveHost)
+	assert.Equal(t, "", catchers[1].Hostname)
+}
+
+func TestIsLocal(t *testing.T) {
+	assert.True(t, isLocal("localhost:6379"))
+	assert.True(t, isLocal("127.0.0.1:6379"))
+	assert.False(t, isLocal("pub-redis-13248.us-east-mz.7.ec2.redislabs.com:13248"))
+}
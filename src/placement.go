@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Placement problems.
+const (
+	sameCatcher  = "primary and backup on the same catcher"
+	sameHostType = "primary and backup on the same host type"
+	sameZone     = "primary and backup in the same availability zone"
+	noBackup     = "no backup"
+)
+
+// PlacementWarning is a source stream whose copies could be lost to a single failure.
+type PlacementWarning struct {
+	StreamID string `json:"streamId"`
+	Primary  string `json:"primary"`
+	Backup   string `json:"backup,omitempty"`
+	Problem  string `json:"problem"`
+	// Inferred is set when the backup was guessed from the primary's partner rather than read from
+	// the nameservice.
+	Inferred bool `json:"inferred,omitempty"`
+}
+
+func (p *PlacementWarning) String() string {
+	inferred := ""
+	if p.Inferred {
+		inferred = " (backup inferred)"
+	}
+	if p.Backup == "" {
+		return fmt.Sprintf("%s on %s: %s%s", p.StreamID, shortHost(p.Primary), p.Problem, inferred)
+	}
+	return fmt.Sprintf("%s on %s and %s: %s%s", p.StreamID, shortHost(p.Primary), shortHost(p.Backup), p.Problem, inferred)
+}
+
+// checkPlacement pairs every stream's catcher with its backup and reports pairs that share a failure
+// domain. The nameservice only records which host is active, so when a stream is active on the
+// catcher holding it the backup is that catcher's partner: the host most often seen on the other side
+// of its streams. Such warnings are marked inferred.
+func checkPlacement(catchers []*Catcher) []*PlacementWarning {
+	byName := make(map[string]*Catcher)
+	for _, c := range catchers {
+		if c.Hostname != "" {
+			byName[shortHost(c.Hostname)] = c
+		}
+	}
+	partners := partnerHosts(catchers)
+
+	ws := []*PlacementWarning{}
+	for _, c := range catchers {
+		for _, s := range c.Streams {
+			backup, inferred := backupHost(c, s, partners)
+			w := &PlacementWarning{StreamID: s.ID, Primary: c.Hostname, Backup: backup, Inferred: inferred}
+			if w.Primary == "" {
+				w.Primary = c.IP
+			}
+			b := byName[shortHost(backup)]
+			switch {
+			case backup == "":
+				w.Problem = noBackup
+			case b == nil:
+				// The backup holds no streams so there is nothing to compare it with.
+				continue
+			default:
+				w.Problem = placementProblem(c, b)
+			}
+			if w.Problem != "" {
+				ws = append(ws, w)
+			}
+		}
+	}
+	sort.Slice(ws, func(i, j int) bool {
+		return ws[i].StreamID < ws[j].StreamID
+	})
+	return ws
+}
+
+// placementProblem returns the failure domain primary c shares with backup b, or "" if none.
+func placementProblem(c, b *Catcher) string {
+	switch {
+	case b.IP == c.IP:
+		return sameCatcher
+	case c.Type != "" && b.Type == c.Type:
+		return sameHostType
+	case c.Zone != "" && b.Zone == c.Zone:
+		return sameZone
+	}
+	return ""
+}
+
+// backupHost returns the host name backing up s on c, or "" if it has none. It reports whether the
+// backup was inferred from c's partner because s is active on c itself.
+func backupHost(c *Catcher, s *SourceStream, partners map[string]string) (string, bool) {
+	if s.ActiveHost == "" || shortHost(s.ActiveHost) == shortHost(c.Hostname) {
+		return partners[shortHost(c.Hostname)], true
+	}
+	return s.ActiveHost, false
+}
+
+// partnerHosts maps each catcher's short host name to the other host it most often shares streams
+// with, named as the catcher reports itself when it holds any streams.
+func partnerHosts(catchers []*Catcher) map[string]string {
+	names := make(map[string]string)
+	for _, c := range catchers {
+		if c.Hostname != "" {
+			names[shortHost(c.Hostname)] = c.Hostname
+		}
+	}
+	counts := make(map[string]map[string]int)
+	pair := func(a, b string) {
+		if counts[a] == nil {
+			counts[a] = make(map[string]int)
+		}
+		counts[a][b]++
+	}
+	for _, c := range catchers {
+		for _, s := range c.Streams {
+			if c.Hostname != "" && s.ActiveHost != "" && shortHost(s.ActiveHost) != shortHost(c.Hostname) {
+				pair(shortHost(c.Hostname), shortHost(s.ActiveHost))
+				pair(shortHost(s.ActiveHost), shortHost(c.Hostname))
+			}
+		}
+	}
+	partners := make(map[string]string)
+	for host, others := range counts {
+		best := ""
+		for other, n := range others {
+			if best == "" || n > others[best] || (n == others[best] && other < best) {
+				best = other
+			}
+		}
+		if name, ok := names[best]; ok {
+			best = name
+		}
+		partners[host] = best
+	}
+	return partners
+}
+
+func (s *server) PlacementJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	hd, ok := s.one(w, r, partCatchers)
+	if !ok {
+		return
+	}
+	serveJson(w, checkPlacement(hd.Catchers))
+}
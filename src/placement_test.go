@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPlacement(t *testing.T) {
+	catchers := []*Catcher{
+		{IP: "10.0.0.1", Hostname: "a.syncbak.corp", Type: "720p", Zone: "us-east-1a", Streams: []*SourceStream{
+			{ID: "S1", ActiveHost: "a.syncbak.corp"},
+			{ID: "S2", ActiveHost: "b.syncbak.corp"},
+			{ID: "S3", ActiveHost: "a"},
+		}},
+		{IP: "10.0.0.2", Hostname: "b.syncbak.corp", Type: "720p", Zone: "us-east-1b", Streams: []*SourceStream{
+			{ID: "S4", ActiveHost: "c.syncbak.corp"},
+		}},
+		{IP: "10.0.0.3", Hostname: "c.syncbak.corp", Type: "1080p", Zone: "us-east-1b", Streams: []*SourceStream{
+			{ID: "S5", ActiveHost: "c.syncbak.corp"},
+			{ID: "S10", ActiveHost: "b"},
+		}},
+		{IP: "10.0.0.4", Hostname: "d.syncbak.corp", Type: "1080p", Streams: []*SourceStream{
+			{ID: "S6", ActiveHost: "spare.syncbak.corp"},
+		}},
+		{IP: "10.0.0.5", Hostname: "e.syncbak.corp", Type: "1080p", Streams: []*SourceStream{
+			{ID: "S7", ActiveHost: "e.syncbak.corp"},
+			{ID: "S8"},
+		}},
+		{IP: "10.0.0.6", Hostname: "f.syncbak.corp", Type: "1080p", Streams: []*SourceStream{
+			{ID: "S9", ActiveHost: "f-alias.syncbak.corp"},
+		}},
+		{IP: "10.0.0.6", Hostname: "f-alias.syncbak.corp", Type: "1080p"},
+	}
+	got := make(map[string]string)
+	var inferred []string
+	for _, w := range checkPlacement(catchers) {
+		got[w.StreamID] = w.Problem
+		if w.Inferred {
+			inferred = append(inferred, w.StreamID)
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"S1":  sameHostType, // backup is a's partner b
+		"S2":  sameHostType,
+		"S3":  sameHostType,
+		"S9":  sameCatcher,
+		"S4":  sameZone,
+		"S5":  sameZone,
+		"S10": sameZone, // short form active host
+		"S7":  noBackup,
+		"S8":  noBackup,
+	}, got)
+	assert.Equal(t, []string{"S1", "S3", "S5", "S7", "S8"}, inferred, "active on their own catcher")
+}
+
+func TestPlacement(t *testing.T) {
+	s := testServer(t)
+
+	w := get(s, "/api/placement")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var ws []*PlacementWarning
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ws))
+	if assert.Len(t, ws, 2) {
+		assert.Equal(t, "WDDD-1004", ws[0].StreamID)
+		assert.Equal(t, noBackup, ws[0].Problem)
+		assert.True(t, ws[0].Inferred)
+	}
+
+	body := get(s, "/").Body.String()
+	assert.Contains(t, body, "Placement warnings")
+	assert.Contains(t, body, "WGGG-1007 on catcher03: no backup (backup inferred)")
+}
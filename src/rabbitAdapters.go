@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+)
+
+// rabbitAdapters reads adapter assignments from the consumers listed by the RabbitMQ management API.
+// Each source stream has its own queue, named queuePrefix and the stream id, and the adapter consuming
+// it owns the stream. The prefix is required so other queues on the broker are not taken for streams.
+// Consumers are
+// live bindings so the window is only passed on to fallback, which is used when the API fails or
+// returns nothing.
+type rabbitAdapters struct {
+	url         string
+	user        string
+	pwd         string
+	vhost       string
+	queuePrefix string
+	client      *http.Client
+	fallback    AdapterSource
+}
+
+var errNoQueuePrefix = errors.New("no rabbitmq queue prefix configured")
+
+// rabbitConsumer is the part of a /api/consumers entry we use.
+type rabbitConsumer struct {
+	Queue struct {
+		Name string `json:"name"`
+	} `json:"queue"`
+	ChannelDetails struct {
+		PeerHost string `json:"peer_host"`
+	} `json:"channel_details"`
+}
+
+func (s *rabbitAdapters) Adapters(ctx context.Context, w window) ([]*Adapter, error) {
+	as, err := s.assignments(ctx)
+	if err == nil && len(as) > 0 {
+		return adaptersFromAssignments(as, s.queuePrefix, time.Now()), nil
+	}
+	if s.fallback == nil {
+		return nil, err
+	}
+	if err != nil {
+		log.Warning("rabbitmq adapter lookup failed, using fallback %s", err)
+	} else {
+		log.Warning("rabbitmq returned no adapter consumers, using fallback")
+	}
+	return s.fallback.Adapters(ctx, w)
+}
+
+// assignments returns the queue to consumer host bindings of every adapter queue.
+func (s *rabbitAdapters) assignments(ctx context.Context) ([]Assignment, error) {
+	if s.queuePrefix == "" {
+		return nil, errNoQueuePrefix
+	}
+	u := strings.TrimRight(s.url, "/") + "/api/consumers/" + url.PathEscape(s.vhost)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(s.user, s.pwd)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rabbitmq %s returned %s", u, resp.Status)
+	}
+
+	var consumers []rabbitConsumer
+	if err := json.NewDecoder(resp.Body).Decode(&consumers); err != nil {
+		return nil, err
+	}
+	var as []Assignment
+	for _, c := range consumers {
+		if !strings.HasPrefix(c.Queue.Name, s.queuePrefix) || c.ChannelDetails.PeerHost == "" {
+			continue
+		}
+		as = append(as, Assignment{Queue: c.Queue.Name, Host: c.ChannelDetails.PeerHost})
+	}
+	return as, nil
+}
+
+// adaptersFromAssignments groups assignments by host. Queue names are source stream ids once
+// queuePrefix is removed. A queue with several consumer hosts is owned by the first of them and the
+// others are recorded in AlsoOn, as a stream logged by several adapters is.
+func adaptersFromAssignments(as []Assignment, queuePrefix string, now time.Time) []*Adapter {
+	consumers := make(map[string][]string)
+	for _, a := range as {
+		if !contains(consumers[a.Queue], a.Host) {
+			consumers[a.Queue] = append(consumers[a.Queue], a.Host)
+		}
+	}
+
+	hosts := make(map[string]*Adapter)
+	for queue, ips := range consumers {
+		sort.Strings(ips)
+		ad, ok := hosts[ips[0]]
+		if !ok {
+			ad = &Adapter{IP: ips[0], LastSeen: now}
+			hosts[ips[0]] = ad
+		}
+		var alsoOn []string
+		if len(ips) > 1 {
+			alsoOn = ips[1:]
+		}
+		ad.Streams = append(ad.Streams, &SourceStream{ID: strings.TrimPrefix(queue, queuePrefix), LastSeen: now, AlsoOn: alsoOn})
+	}
+
+	adapters := make([]*Adapter, 0, len(hosts))
+	for _, a := range hosts {
+		sortStreams(a.Streams)
+		adapters = append(adapters, a)
+	}
+	sort.Slice(adapters, func(i, j int) bool {
+		return adapters[i].IP < adapters[j].IP
+	})
+	return adapters
+}
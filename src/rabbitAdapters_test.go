@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const consumersJSON = `[
+	{"queue": {"name": "ss.KAAA-1001", "vhost": "/"}, "channel_details": {"peer_host": "10.10.2.11"}},
+	{"queue": {"name": "ss.KBBB-1002", "vhost": "/"}, "channel_details": {"peer_host": "10.10.2.11"}},
+	{"queue": {"name": "ss.WCCC-1003", "vhost": "/"}, "channel_details": {"peer_host": "10.10.2.12"}},
+	{"queue": {"name": "ss.WCCC-1003", "vhost": "/"}, "channel_details": {"peer_host": "10.10.2.12"}},
+	{"queue": {"name": "ss.KFFF-1006", "vhost": "/"}, "channel_details": {"peer_host": "10.10.2.12"}},
+	{"queue": {"name": "ss.KFFF-1006", "vhost": "/"}, "channel_details": {"peer_host": "10.10.2.11"}},
+	{"queue": {"name": "aliveness-test", "vhost": "/"}, "channel_details": {"peer_host": "10.10.9.9"}}
+]`
+
+func TestRabbitAdapters(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pwd, _ := r.BasicAuth()
+		assert.Equal(t, "guest", user)
+		assert.Equal(t, "secret", pwd)
+		assert.Equal(t, "/api/consumers/%2F", r.URL.EscapedPath())
+		w.Write([]byte(consumersJSON))
+	}))
+	defer ts.Close()
+
+	s := &rabbitAdapters{url: ts.URL, user: "guest", pwd: "secret", vhost: "/", queuePrefix: "ss.", client: ts.Client(),
+		fallback: failing{err: errors.New("fallback should not be used")}}
+	adapters, err := s.Adapters(context.Background(), window{})
+	assert.Nil(t, err, "%s", err)
+	assert.Len(t, adapters, 2)
+	assert.Equal(t, "10.10.2.11", adapters[0].IP)
+	assert.Equal(t, "KBBB-1002", adapters[0].Streams[1].ID)
+	if assert.Len(t, adapters[0].Streams, 3) {
+		assert.Equal(t, "KFFF-1006", adapters[0].Streams[2].ID)
+		assert.Equal(t, []string{"10.10.2.12"}, adapters[0].Streams[2].AlsoOn)
+	}
+	assert.Len(t, adapters[1].Streams, 1)
+	assert.Equal(t, []*SplitStream{{ID: "KFFF-1006", IPs: []string{"10.10.2.11", "10.10.2.12"}}}, splitStreams(adapters))
+
+	s.queuePrefix = ""
+	_, err = s.assignments(context.Background())
+	assert.Equal(t, errNoQueuePrefix, err, "every queue on the broker would be a stream")
+}
+
+func TestRabbitAdaptersFallback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	f := &fixture{AdapterList: []*Adapter{{IP: "10.10.2.99"}}}
+	s := &rabbitAdapters{url: ts.URL, vhost: "/", client: ts.Client(), fallback: f}
+	adapters, err := s.Adapters(context.Background(), window{})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, "10.10.2.99", adapters[0].IP)
+
+	s.fallback = nil
+	_, err = s.Adapters(context.Background(), window{})
+	assert.NotNil(t, err)
+}
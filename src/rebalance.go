@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+const defaultRebalanceTarget = 0.8
+
+// Move is a single stream reassignment proposed by a rebalance plan.
+type Move struct {
+	StreamID string `json:"streamId"`
+	From     string `json:"from"`
+	FromIP   string `json:"fromIp"`
+	To       string `json:"to"`
+	ToIP     string `json:"toIp"`
+	Type     string `json:"type"`
+}
+
+// CatcherLoad is a catcher's stream count before and after a plan is applied.
+type CatcherLoad struct {
+	Host     string `json:"host"`
+	IP       string `json:"ip"`
+	Type     string `json:"type"`
+	Capacity int    `json:"capacity"`
+	// Limit is the most streams the catcher may hold at the plan's target utilization.
+	Limit  int `json:"limit"`
+	Before int `json:"before"`
+	After  int `json:"after"`
+	// Maintenance describes the catcher's maintenance window, if it is in one.
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// Over reports whether the catcher is still above its limit once the plan is applied.
+func (l *CatcherLoad) Over() bool {
+	return l.After > l.Limit
+}
+
+// RebalancePlan is a proposed set of moves bringing every catcher under Target utilization. Nothing is
+// written to the nameservice; the plan is for review.
+type RebalancePlan struct {
+	Target float64        `json:"target"`
+	Moves  []*Move        `json:"moves"`
+	Loads  []*CatcherLoad `json:"loads"`
+	// Unresolved counts the streams left above a limit because no eligible catcher had room.
+	Unresolved int `json:"unresolved"`
+}
+
+// planRebalance moves the fewest streams it can off catchers above target utilization, starting with
+// the catcher furthest over its limit. A stream only moves to a catcher of the same host type with room
+// under its limit that is neither the source host nor the stream's backup, and whose placement against
+// the backup raises no warning from checkPlacement that the stream does not already have. The least
+// utilized eligible catcher is chosen each time. The plan is greedy, so it is not always the fewest
+// moves possible, and backups inferred from partners are taken as they are before the plan is applied.
+func planRebalance(catchers []*Catcher, capacity func(*Catcher) int, target float64) *RebalancePlan {
+	plan := &RebalancePlan{Target: target, Moves: []*Move{}}
+	partners := partnerHosts(catchers)
+	byName := make(map[string]*Catcher)
+	loads := make(map[*Catcher]*CatcherLoad)
+	for _, c := range catchers {
+		l := &CatcherLoad{Host: c.Hostname, IP: c.IP, Type: c.Type, Capacity: capacity(c), Before: len(c.Streams)}
+		l.Limit = int(float64(l.Capacity) * target)
+		l.After = l.Before
+		loads[c] = l
+		plan.Loads = append(plan.Loads, l)
+		if c.Hostname != "" {
+			byName[shortHost(c.Hostname)] = c
+		}
+	}
+	utilization := func(l *CatcherLoad) float64 {
+		if l.Capacity == 0 {
+			return float64(l.After)
+		}
+		return float64(l.After) / float64(l.Capacity)
+	}
+	sources := make([]*Catcher, len(catchers))
+	copy(sources, catchers)
+	sort.SliceStable(sources, func(i, j int) bool {
+		a, b := loads[sources[i]], loads[sources[j]]
+		if a.After-a.Limit != b.After-b.Limit {
+			return a.After-a.Limit > b.After-b.Limit
+		}
+		return utilization(a) > utilization(b)
+	})
+
+	for _, c := range sources {
+		from := loads[c]
+		streams := make([]*SourceStream, len(c.Streams))
+		copy(streams, c.Streams)
+		sortStreams(streams)
+		for i := len(streams) - 1; i >= 0 && from.Over(); i-- {
+			s := streams[i]
+			backup, _ := backupHost(c, s, partners)
+			b := byName[shortHost(backup)]
+			var to *Catcher
+			for _, d := range catchers {
+				l := loads[d]
+				if d.IP == c.IP || d.Type != c.Type || l.After >= l.Limit {
+					continue
+				}
+				if backup != "" && shortHost(d.Hostname) == shortHost(backup) {
+					continue
+				}
+				if b != nil {
+					if p := placementProblem(d, b); p != "" && p != placementProblem(c, b) {
+						continue
+					}
+				}
+				if to == nil || utilization(l) < utilization(loads[to]) {
+					to = d
+				}
+			}
+			if to == nil {
+				continue
+			}
+			plan.Moves = append(plan.Moves, &Move{StreamID: s.ID, From: c.Hostname, FromIP: c.IP, To: to.Hostname, ToIP: to.IP, Type: c.Type})
+			from.After--
+			loads[to].After++
+		}
+		if from.Over() {
+			plan.Unresolved += from.After - from.Limit
+		}
+	}
+	sort.Slice(plan.Moves, func(i, j int) bool {
+		return plan.Moves[i].StreamID < plan.Moves[j].StreamID
+	})
+	return plan
+}
+
+// rebalance plans a rebalance of the current catchers for the target in r's query, writing an error
+// response if it cannot.
+func (s *server) rebalance(w http.ResponseWriter, r *http.Request) (*RebalancePlan, bool) {
+	target := s.rebalanceTarget
+	if target <= 0 {
+		target = defaultRebalanceTarget
+	}
+	if v := r.URL.Query().Get("target"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t <= 0 || t > 1 {
+			http.Error(w, fmt.Sprintf("target %q must be a utilization between 0 and 1", v), http.StatusBadRequest)
+			return nil, false
+		}
+		target = t
+	}
+	hd, ok := s.one(w, r, partCatchers)
+	if !ok {
+		return nil, false
+	}
+	limits := s.limits(r.Context())
+	plan := planRebalance(hd.Catchers, limits.catcherCapacity, target)
+	for _, l := range plan.Loads {
+		l.Maintenance = limits.maintenance(l.Host, l.IP)
+	}
+	return plan, true
+}
+
+func (s *server) Rebalance(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	plan, ok := s.rebalance(w, r)
+	if !ok {
+		return
+	}
+	err := templates.ExecuteTemplate(w, "rebalance.html", plan)
+	if err != nil {
+		log.Error("error executing template %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// RebalanceJSON serves the plan as a JSON download for review.
+func (s *server) RebalanceJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	plan, ok := s.rebalance(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="rebalance.json"`)
+	serveJson(w, plan)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanRebalance(t *testing.T) {
+	catchers := []*Catcher{
+		{IP: "10.0.0.1", Hostname: "a", Type: "720p", Streams: []*SourceStream{
+			{ID: "S1", ActiveHost: "a"}, {ID: "S2", ActiveHost: "a"}, {ID: "S3", ActiveHost: "a"},
+			{ID: "S4", ActiveHost: "a"}, {ID: "S5", ActiveHost: "b"},
+		}},
+		{IP: "10.0.0.2", Hostname: "b", Type: "720p"},
+		{IP: "10.0.0.3", Hostname: "c", Type: "720p", Streams: []*SourceStream{{ID: "S6", ActiveHost: "c"}}},
+		{IP: "10.0.0.4", Hostname: "d", Type: "1080p", Streams: []*SourceStream{
+			{ID: "S7"}, {ID: "S8"}, {ID: "S9"},
+		}},
+	}
+	capacity := func(*Catcher) int { return 4 }
+	plan := planRebalance(catchers, capacity, 0.5)
+
+	// b backs up every stream on a, so only c can take them.
+	assert.Equal(t, []*Move{
+		{StreamID: "S5", From: "a", FromIP: "10.0.0.1", To: "c", ToIP: "10.0.0.3", Type: "720p"},
+	}, plan.Moves)
+	after := make(map[string]int)
+	for _, l := range plan.Loads {
+		after[l.Host] = l.After
+	}
+	assert.Equal(t, map[string]int{"a": 4, "b": 0, "c": 2, "d": 3}, after)
+	// a is 2 over its limit of 2 and d, with no other 1080p catcher, 1 over.
+	assert.Equal(t, 3, plan.Unresolved)
+
+	catchers[0].Streams[4].ActiveHost = "a"
+	plan = planRebalance(catchers, capacity, 0.5)
+	assert.Len(t, plan.Moves, 3)
+	assert.Equal(t, 1, plan.Unresolved)
+}
+
+func TestPlanRebalanceOrder(t *testing.T) {
+	streamsOn := func(host string, ids ...string) []*SourceStream {
+		var ss []*SourceStream
+		for _, id := range ids {
+			ss = append(ss, &SourceStream{ID: id, ActiveHost: host})
+		}
+		return ss
+	}
+	catchers := []*Catcher{
+		{IP: "10.0.0.1", Hostname: "x", Type: "720p", Streams: streamsOn("x", "X1", "X2", "X3")},
+		{IP: "10.0.0.2", Hostname: "y", Type: "720p", Streams: streamsOn("y", "Y1", "Y2", "Y3", "Y4", "Y5")},
+		{IP: "10.0.0.3", Hostname: "z", Type: "720p"},
+	}
+	plan := planRebalance(catchers, func(*Catcher) int { return 4 }, 0.5)
+	if assert.Len(t, plan.Moves, 2) {
+		assert.Equal(t, "y", plan.Moves[0].From, "the catcher furthest over its limit goes first")
+		assert.Equal(t, "y", plan.Moves[1].From)
+	}
+	assert.Equal(t, 2, plan.Unresolved)
+
+	catchers = []*Catcher{
+		{IP: "10.0.0.1", Hostname: "p", Type: "720p", Zone: "us-east-1a", Streams: streamsOn("q", "S1", "S2")},
+		{IP: "10.0.0.2", Hostname: "q", Type: "1080p", Zone: "us-east-1b"},
+		{IP: "10.0.0.3", Hostname: "r", Type: "720p", Zone: "us-east-1b"},
+		{IP: "10.0.0.4", Hostname: "s", Type: "720p", Zone: "us-east-1c"},
+	}
+	plan = planRebalance(catchers, func(*Catcher) int { return 2 }, 0.5)
+	if assert.Len(t, plan.Moves, 1) {
+		assert.Equal(t, "s", plan.Moves[0].To, "r shares a zone with the backup q")
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	s := testServer(t)
+
+	w := get(s, "/api/rebalance")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var plan RebalancePlan
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &plan))
+	assert.Equal(t, defaultRebalanceTarget, plan.Target)
+	assert.Empty(t, plan.Moves)
+
+	// catcher01 is the only 720p catcher so its third stream has nowhere to go.
+	w = get(s, "/api/rebalance?target=0.3")
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &plan))
+	assert.Empty(t, plan.Moves)
+	assert.Equal(t, 1, plan.Unresolved)
+
+	assert.Equal(t, http.StatusBadRequest, get(s, "/api/rebalance?target=2").Code)
+	w = get(s, "/rebalance?target=0.3")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "1 streams stay above target")
+}
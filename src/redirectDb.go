@@ -1,33 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"time"
+	"sort"
 
 	"github.com/Syncbak-Git/log"
 	"github.com/garyburd/redigo/redis"
 )
 
-type Redirect struct {
-	Streams   int       `json: "streams"`
-	Max       int       `json: "max"`
-	Host      string    `json: "host"`
-	Timestamp time.Time `json:"timestamp"`
-}
-
 type redirectDb struct {
-	server string
-	pwd    string
+	redisServer
 	prefix string
 }
 
-func newRedirectDb(addr, pwd, prexif string) *redirectDb {
-	return &redirectDb{server: addr, pwd: pwd, prefix: prexif}
-}
-
-func (r *Redirect) Since() int64 {
-	return int64(time.Since(r.Timestamp) / time.Second)
+func newRedirectDb(rs redisServer, prexif string) *redirectDb {
+	return &redirectDb{redisServer: rs, prefix: prexif}
 }
 
 func check(err error) {
@@ -38,41 +27,53 @@ func check(err error) {
 
 const redirectKey = "ns:redirect:"
 
-func (db *redirectDb) streams() ([]*Redirect, error) {
-	conn, err := db.connect()
-	check(err)
+func (db *redirectDb) key() string {
+	return fmt.Sprintf("%s%s", redirectKey, db.prefix)
+}
 
-	vals, err := redis.ByteSlices(conn.Do("HGETALL", fmt.Sprintf("%s%s", redirectKey, db.prefix)))
-	check(err)
+// entries returns the raw redirect hash, keyed by field.
+func (db *redirectDb) entries(ctx context.Context) (map[string][]byte, error) {
+	conn, err := db.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
 
-	var redirects []*Redirect
+	vals, err := redis.ByteSlices(conn.Do("HGETALL", db.key()))
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
 
-	for i, val := range vals {
-		if i%2 == 1 {
-			s := &Redirect{}
-			err = json.Unmarshal(val, s)
-			if err != nil {
-				log.Error("Error unmarshalling redirect bytes %s error %s", string(val), err.Error())
-				continue
-			}
-			if time.Since(s.Timestamp) < 2*time.Minute {
-				redirects = append(redirects, s)
-			}
-		}
+	entries := make(map[string][]byte)
+	for i := 0; i+1 < len(vals); i += 2 {
+		entries[string(vals[i])] = vals[i+1]
 	}
-	return redirects, nil
+	return entries, nil
 }
 
-func (db *redirectDb) connect() (redis.Conn, error) {
-	to := 2 * time.Second
-	conn, err := redis.DialTimeout("tcp", db.server, to, to, to)
-	check(err)
+// Redirects returns the redirect hosts whose last report falls inside w. The hash only keeps the latest
+// report from each host.
+func (db *redirectDb) Redirects(ctx context.Context, w window) ([]*RedirectHost, error) {
+	vals, err := db.entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var redirects []*RedirectHost
 
-	if len(db.pwd) > 0 {
-		if _, err := conn.Do("AUTH", db.pwd); err != nil {
-			conn.Close()
-			return nil, err
+	for _, val := range vals {
+		s := &RedirectHost{}
+		err = json.Unmarshal(val, s)
+		if err != nil {
+			log.Error("Error unmarshalling redirect bytes %s error %s", string(val), err.Error())
+			continue
+		}
+		if w.contains(s.Timestamp) {
+			redirects = append(redirects, s)
 		}
 	}
-	return conn, nil
+	sort.Slice(redirects, func(i, j int) bool {
+		return redirects[i].Host < redirects[j].Host
+	})
+	return redirects, nil
 }
@@ -1,20 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-const nameServiceDbAddr = "pub-redis-13248.us-east-mz.7.ec2.redislabs.com:13248"
-const nameServiceDbPw = "=cLGW9&GQjCYu$2Z5+7K#6ED"
 const redirectPrexif = "p6-qa"
 
+// TestNS runs against a real nameservice redis. Set NAMESERVICE_REDIS (and NAMESERVICE_REDIS_PWD if
+// needed) to enable it.
 func TestNS(t *testing.T) {
-	ndb := newRedirectDb(nameServiceDbAddr, nameServiceDbPw, redirectPrexif)
+	nameServiceDbAddr := os.Getenv("NAMESERVICE_REDIS")
+	if nameServiceDbAddr == "" {
+		t.Skip("NAMESERVICE_REDIS not set")
+	}
+	ndb := newRedirectDb(redisServer{addr: nameServiceDbAddr, pwd: os.Getenv("NAMESERVICE_REDIS_PWD"), timeout: 2 * time.Second}, redirectPrexif)
 
-	streams, err := ndb.streams()
+	streams, err := ndb.Redirects(context.Background(), lastWindow(2*time.Minute, time.Now()))
 	fmt.Println(streams)
 	assert.Nil(t, err, "%s", err)
 
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// dialRedis connects to server for the life of ctx. The dial is abandoned when ctx ends, read and
+// write timeouts never outlast ctx's deadline, and the connection is closed as soon as ctx is done so
+// a blocked read returns. Close the connection when finished to release the watcher.
+func dialRedis(ctx context.Context, server, pwd string, timeout time.Duration) (redis.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < timeout {
+			timeout = left
+		}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := redis.Dial("tcp", server,
+		redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}),
+		redis.DialReadTimeout(timeout),
+		redis.DialWriteTimeout(timeout),
+		redis.DialPassword(pwd))
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return &ctxConn{Conn: conn, done: done}, nil
+}
+
+// redisServer is a redis server the dashboard reads the nameservice from or keeps its own state in.
+type redisServer struct {
+	addr    string
+	pwd     string
+	timeout time.Duration
+}
+
+func (rs redisServer) connect(ctx context.Context) (redis.Conn, error) {
+	return dialRedis(ctx, rs.addr, rs.pwd, rs.timeout)
+}
+
+// do runs a single command on a connection of its own.
+func (rs redisServer) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := rs.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	reply, err := conn.Do(cmd, args...)
+	return reply, ctxErr(ctx, err)
+}
+
+// ctxConn stops the context watcher started by dialRedis when it is closed.
+type ctxConn struct {
+	redis.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *ctxConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// ctxErr reports ctx's error in place of err once ctx has ended, since an error from a connection
+// closed on cancellation says nothing useful. A read timeout capped by ctx's deadline can fire just
+// before ctx's own timer does, so a passed deadline counts as ended.
+func ctxErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// silentRedis accepts connections and reads commands but never answers.
+func silentRedis(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "%s", err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ioutil.ReadAll(c)
+		}
+	}()
+	return l
+}
+
+func TestRedisReadHonorsContext(t *testing.T) {
+	l := silentRedis(t)
+	defer l.Close()
+
+	db := newNameserviceDb(redisServer{addr: l.Addr().String(), timeout: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := db.Catchers(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err = newRedirectDb(redisServer{addr: l.Addr().String(), timeout: time.Minute}, "p6-qa").Redirects(ctx, lastWindow(time.Minute, time.Now()))
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestRedisServerTimeout(t *testing.T) {
+	l := silentRedis(t)
+	defer l.Close()
+
+	rs := redisServer{addr: l.Addr().String(), timeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err := newRedisAnnotations(rs, "notes").Annotations(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second, "the configured timeout applies")
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Syncbak-Git/jsconfig"
+	"github.com/Syncbak-Git/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// server holds the backends the handlers read from.
+type server struct {
+	catchers    CatcherSource
+	adapters    AdapterSource
+	transcoders TranscoderSource
+	redirects   RedirectSource
+	maxCatcher  int
+	maxAdapter  int
+	// capacity by catcher host type and per host, overridden by capacityDb when it is set
+	typeCapacity map[string]int
+	hostCapacity map[string]int
+	capacityDb   *capacityDb
+	// default utilization the rebalance planner aims for
+	rebalanceTarget float64
+	// default observation windows for the log derived views
+	adapterWindow    time.Duration
+	transcoderWindow time.Duration
+	redirectWindow   time.Duration
+	// how long each backend may take before a page is rendered without it
+	catcherTimeout    time.Duration
+	redirectTimeout   time.Duration
+	adapterTimeout    time.Duration
+	transcoderTimeout time.Duration
+	breakers          map[part]*breaker
+	consistency       *reconciler
+	// tracker logs stream movements and snapshots, nil when no event log is configured
+	tracker *tracker
+	// a stream changing more than flapThreshold times in flapWindow is flapping
+	flapThreshold int
+	flapWindow    time.Duration
+	// alerts delivers alerts from every check
+	alerts *alerter
+	// anomalies judges sampled stream and slot counts, nil when no sample log is configured
+	anomalies *anomalyDetector
+	// lineup is the expected station lineup, nil when none is configured
+	lineup lineupStore
+	// catalog describes stations by call sign, nil when no catalog is configured
+	catalog *catalog
+	// maint holds the hosts' maintenance windows, nil when none are configured
+	maint maintenanceStore
+	// notes holds operator annotations on hosts and streams, nil when none are configured
+	notes annotationStore
+	// audit journals every write to the nameservice and redirect keys, nil when no journal is configured
+	audit *auditor
+}
+
+// newServer builds a server from settings. When "DemoFixture" names a fixture file every backend is
+// served from it instead of redis and elasticsearch.
+func newServer(s jsconfig.Settings) (*server, error) {
+	srv := &server{
+		maxCatcher: s.FindInt("MaxStreamsCatcher"),
+		maxAdapter: s.FindInt("MaxStreamsAdapter"),
+
+		typeCapacity: intMap(s.FindMap("CatcherTypeCapacity")),
+		hostCapacity: intMap(s.FindMap("HostCapacity")),
+
+		rebalanceTarget: s.FindNumber("RebalanceTarget"),
+
+		adapterWindow:    durationOr(s.FindDuration("AdapterWindow"), 10*time.Minute),
+		transcoderWindow: durationOr(s.FindDuration("TranscoderWindow"), 4*time.Minute),
+		redirectWindow:   durationOr(s.FindDuration("RedirectWindow"), 2*time.Minute),
+
+		catcherTimeout:    durationOr(s.FindDuration("CatcherTimeout"), 4*time.Second),
+		redirectTimeout:   durationOr(s.FindDuration("RedirectTimeout"), 2*time.Second),
+		adapterTimeout:    durationOr(s.FindDuration("AdapterTimeout"), 3*time.Second),
+		transcoderTimeout: durationOr(s.FindDuration("TranscoderTimeout"), 3*time.Second),
+		breakers:          make(map[part]*breaker),
+		consistency:       newReconciler(),
+		flapThreshold:     s.FindInt("FlapThreshold"),
+		flapWindow:        s.FindDuration("FlapWindow"),
+	}
+	failures := s.FindInt("BreakerFailures")
+	if failures <= 0 {
+		failures = 3
+	}
+	cooldown := durationOr(s.FindDuration("BreakerCooldown"), 30*time.Second)
+	for p, name := range partNames {
+		srv.breakers[p] = newBreaker(name, failures, cooldown)
+	}
+	if path := s.FindString("EventLog"); path != "" {
+		var st *snapshotStore
+		if snaps := s.FindString("SnapshotLog"); snaps != "" {
+			st = newSnapshotStore(snaps)
+		}
+		srv.tracker = newTracker(newEventLog(path), st)
+	}
+	srv.alerts = newAlerter(s.FindStringSlice("AlertWebhooks"))
+	srv.alerts.offline = srv.offline
+	srv.alerts.maintenance = srv.maintenance
+	if path := s.FindString("SampleLog"); path != "" {
+		weeks := s.FindInt("BaselineWeeks")
+		if weeks <= 0 {
+			weeks = defaultBaselineWeeks
+		}
+		deviations := s.FindNumber("AnomalyDeviations")
+		if deviations <= 0 {
+			deviations = defaultAnomalyDeviations
+		}
+		srv.anomalies = newAnomalyDetector(newSampleStore(path, time.Duration(weeks)*7*24*time.Hour), deviations, srv.alerts)
+	}
+	if path := s.FindString("LineupFile"); path != "" {
+		srv.lineup = newFileLineup(path)
+	}
+	if path := s.FindString("StationCatalog"); path != "" {
+		c, err := loadCatalog(path)
+		if err != nil {
+			return nil, err
+		}
+		srv.catalog = c
+	}
+	proxies, err := parseProxies(s.FindStringSlice("AuditTrustedProxies"))
+	if err != nil {
+		return nil, err
+	}
+	if path := s.FindString("DemoFixture"); path != "" {
+		f, err := loadFixture(path)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("demo mode: serving fixture %s", path)
+		srv.catchers, srv.adapters, srv.transcoders, srv.redirects = f, f, f, f
+		srv.maint = newMemMaintenance()
+		srv.notes = &memAnnotations{}
+		srv.audit = newAuditor(newMemAudit(), s.FindString("AuditUserHeader"), redirectKey+s.FindString("RedirectPrefix"), proxies)
+		return srv, nil
+	}
+	cluster := s.FindString("ElasticCluster")
+	rs := redisServer{addr: s.FindString("Redis"), pwd: s.FindString("RedisPwd"), timeout: redisTimeout(s)}
+	srv.catchers = newNameserviceDb(rs)
+	redirects := newRedirectDb(rs, s.FindString("RedirectPrefix"))
+	srv.redirects = redirects
+	if key := s.FindString("LineupHash"); key != "" {
+		srv.lineup = newRedisLineup(rs, key)
+	}
+	if key := s.FindString("MaintenanceHash"); key != "" {
+		srv.maint = newRedisMaintenance(rs, key)
+	}
+	if key := s.FindString("AuditList"); key != "" {
+		srv.audit = newAuditor(newRedisAudit(rs, key), s.FindString("AuditUserHeader"), redirects.key(), proxies)
+	}
+	if key := s.FindString("AnnotationList"); key != "" {
+		srv.notes = newRedisAnnotations(rs, key)
+	}
+	if key := s.FindString("CapacityHash"); key != "" {
+		srv.capacityDb = newCapacityDb(rs, key)
+	}
+	srv.adapters = &esAdapters{cluster: cluster}
+	if s.FindString("AdapterSource") == "rabbitmq" {
+		if s.FindString("RabbitQueuePrefix") == "" {
+			return nil, errors.New("AdapterSource rabbitmq needs a RabbitQueuePrefix naming the source stream queues")
+		}
+		srv.adapters = &rabbitAdapters{
+			url:         s.FindString("RabbitURL"),
+			user:        s.FindString("RabbitUser"),
+			pwd:         s.FindString("RabbitPwd"),
+			vhost:       s.FindString("RabbitVhost"),
+			queuePrefix: s.FindString("RabbitQueuePrefix"),
+			client:      &http.Client{Timeout: 4 * time.Second},
+			fallback:    srv.adapters,
+		}
+	}
+	srv.transcoders = &esTranscoders{cluster: cluster}
+	return srv, nil
+}
+
+func (s *server) routes() *httprouter.Router {
+	r := httprouter.New()
+	r.GET("/", s.Home)
+	r.GET("/catchers/count", s.CatcherCount)
+	r.GET("/catchers/slots", s.CatcherSlots)
+	r.GET("/adapters", s.Adapters)
+	r.GET("/adapters/count", s.AdapterCount)
+	r.GET("/adapters/slots", s.AdapterSlots)
+	r.GET("/adapters/slotsused", s.AdapterSlotsUsed)
+	r.GET("/transcoders", s.Transcoders)
+	r.GET("/transcoders/streams", s.ActiveStreams)
+	r.GET("/transcoders/workers", s.WorkersInUse)
+	r.GET("/consistency", s.Consistency)
+	r.GET("/rebalance", s.Rebalance)
+	r.GET("/simulate", s.Simulate)
+	r.GET("/events", s.Events)
+	r.GET("/snapshots/diff", s.SnapshotDiff)
+	r.GET("/lineup", s.Lineup)
+	r.GET("/audit", s.Audit)
+	r.POST("/audit/:id/rollback", s.Rollback)
+	r.GET("/health", s.Health)
+	r.GET("/api/catchers", s.Catchers)
+	r.GET("/api/adapters", s.AdaptersJSON)
+	r.GET("/api/adapters/split", s.SplitStreams)
+	r.GET("/api/transcoders", s.TranscodersJSON)
+	r.GET("/api/placement", s.PlacementJSON)
+	r.GET("/api/rebalance", s.RebalanceJSON)
+	r.GET("/api/simulate", s.SimulateJSON)
+	r.GET("/api/events", s.EventsJSON)
+	r.GET("/api/flapping", s.FlappingJSON)
+	r.GET("/api/anomalies", s.AnomaliesJSON)
+	r.GET("/api/lineup", s.LineupJSON)
+	r.GET("/api/lineup/stations", s.LineupStations)
+	r.PUT("/api/lineup/stations/:id", s.PutLineupStation)
+	r.DELETE("/api/lineup/stations/:id", s.DeleteLineupStation)
+	r.GET("/api/catalog", s.CatalogJSON)
+	r.POST("/api/catalog", s.ImportCatalog)
+	r.GET("/api/maintenance", s.MaintenanceJSON)
+	r.POST("/api/maintenance", s.AddMaintenance)
+	r.DELETE("/api/maintenance/:id", s.DeleteMaintenance)
+	r.GET("/api/annotations", s.AnnotationsJSON)
+	r.POST("/api/annotations", s.AddAnnotation)
+	r.GET("/api/audit", s.AuditJSON)
+	r.POST("/api/audit/:id/rollback", s.RollbackJSON)
+	r.GET("/api/snapshots/diff", s.SnapshotDiffJSON)
+	r.GET("/api/consistency", s.ConsistencyJSON)
+	r.GET("/api/consistency.xml", s.ConsistencyJUnit)
+	return r
+}
+
+// redisTimeout is how long a redis connection, command or reply may take, RedisTimeout or 2s.
+func redisTimeout(s jsconfig.Settings) time.Duration {
+	return durationOr(s.FindDuration("RedisTimeout"), 2*time.Second)
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// window returns the observation window for r, writing a bad request response if the query is invalid.
+func (s *server) window(w http.ResponseWriter, r *http.Request, def time.Duration) (window, bool) {
+	win, err := requestWindow(r, def, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return window{}, false
+	}
+	return win, true
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Failover is a stream taken over by another host when the host it was on fails.
+type Failover struct {
+	StreamID string `json:"streamId"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// DarkStream is a stream left with nowhere to run.
+type DarkStream struct {
+	StreamID string `json:"streamId"`
+	Host     string `json:"host"`
+	Reason   string `json:"reason"`
+}
+
+// HostLoad is a surviving or failed host's stream count before and after a simulated failure.
+type HostLoad struct {
+	Host     string `json:"host"`
+	IP       string `json:"ip"`
+	Capacity int    `json:"capacity"`
+	Before   int    `json:"before"`
+	After    int    `json:"after"`
+	Failed   bool   `json:"failed"`
+	// Maintenance describes the host's maintenance window, if it is in one.
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// Over reports whether the host would hold more streams than its capacity.
+func (l *HostLoad) Over() bool {
+	return !l.Failed && l.After > l.Capacity
+}
+
+// Simulation is the predicted effect of losing a set of hosts.
+type Simulation struct {
+	Failed []string `json:"failed"`
+	// CatcherFailovers are streams whose backup catcher takes over.
+	CatcherFailovers []*Failover `json:"catcherFailovers"`
+	// AdapterFailovers are streams picked up by another adapter.
+	AdapterFailovers []*Failover   `json:"adapterFailovers"`
+	Dark             []*DarkStream `json:"dark"`
+	// Unprotected are streams still running whose backup failed.
+	Unprotected []string       `json:"unprotected"`
+	Catchers    []*HostLoad    `json:"catchers"`
+	Adapters    []*HostLoad    `json:"adapters"`
+	Degraded    []*Degradation `json:"degraded"`
+}
+
+// Overloaded lists the surviving hosts pushed over capacity.
+func (sim *Simulation) Overloaded() []*HostLoad {
+	var over []*HostLoad
+	for _, l := range append(append([]*HostLoad{}, sim.Catchers...), sim.Adapters...) {
+		if l.Over() {
+			over = append(over, l)
+		}
+	}
+	return over
+}
+
+// hostSet matches hosts by full name, short name or ip.
+type hostSet map[string]bool
+
+func (hs hostSet) has(name, ip string) bool {
+	return hs[ip] || (name != "" && (hs[name] || hs[shortHost(name)]))
+}
+
+// simulateFailure predicts what happens when the failed hosts go down. A stream on a failed catcher
+// fails over to its backup, found as in checkPlacement, and goes dark without one. Adapters have no
+// fixed backups; a failed adapter's streams are requeued and picked up by the least loaded survivor,
+// which is only possible while some adapter survives.
+func simulateFailure(catchers []*Catcher, adapters []*Adapter, failed hostSet, limits *capacityLimits) *Simulation {
+	sim := &Simulation{CatcherFailovers: []*Failover{}, AdapterFailovers: []*Failover{}, Dark: []*DarkStream{}, Unprotected: []string{}}
+	for h := range failed {
+		sim.Failed = append(sim.Failed, h)
+	}
+	sort.Strings(sim.Failed)
+
+	partners := partnerHosts(catchers)
+	byName := make(map[string]*HostLoad)
+	catcherLoads := make(map[*Catcher]*HostLoad)
+	for _, c := range catchers {
+		l := &HostLoad{Host: c.Hostname, IP: c.IP, Capacity: limits.catcherCapacity(c), Before: len(c.Streams),
+			Failed: failed.has(c.Hostname, c.IP), Maintenance: limits.maintenance(c.Hostname, c.IP)}
+		if !l.Failed {
+			l.After = l.Before
+		}
+		catcherLoads[c] = l
+		if c.Hostname != "" {
+			byName[shortHost(c.Hostname)] = l
+		}
+		sim.Catchers = append(sim.Catchers, l)
+	}
+	for _, c := range catchers {
+		from := catcherLoads[c]
+		for _, s := range c.Streams {
+			backup, _ := backupHost(c, s, partners)
+			to := byName[shortHost(backup)]
+			switch {
+			case !from.Failed:
+				if backup != "" && (failed.has(backup, "") || (to != nil && to.Failed)) {
+					sim.Unprotected = append(sim.Unprotected, s.ID)
+				}
+			case backup == "":
+				sim.Dark = append(sim.Dark, &DarkStream{StreamID: s.ID, Host: c.Hostname, Reason: "no backup"})
+			case to == nil:
+				sim.Dark = append(sim.Dark, &DarkStream{StreamID: s.ID, Host: c.Hostname, Reason: "backup " + shortHost(backup) + " holds no streams"})
+			case to.Failed:
+				sim.Dark = append(sim.Dark, &DarkStream{StreamID: s.ID, Host: c.Hostname, Reason: "backup " + shortHost(backup) + " also failed"})
+			default:
+				to.After++
+				sim.CatcherFailovers = append(sim.CatcherFailovers, &Failover{StreamID: s.ID, From: c.Hostname, To: to.Host})
+			}
+		}
+	}
+
+	var survivors []*HostLoad
+	adapterLoads := make(map[*Adapter]*HostLoad)
+	for _, a := range adapters {
+		l := &HostLoad{Host: a.IP, IP: a.IP, Capacity: limits.adapterCapacity(a), Before: len(a.Streams), Failed: failed.has("", a.IP),
+			Maintenance: limits.maintenance(a.IP)}
+		if !l.Failed {
+			l.After = l.Before
+			survivors = append(survivors, l)
+		}
+		adapterLoads[a] = l
+		sim.Adapters = append(sim.Adapters, l)
+	}
+	for _, a := range adapters {
+		if !adapterLoads[a].Failed {
+			continue
+		}
+		for _, s := range a.Streams {
+			if len(survivors) == 0 {
+				sim.Dark = append(sim.Dark, &DarkStream{StreamID: s.ID, Host: a.IP, Reason: "no adapter left"})
+				continue
+			}
+			sort.SliceStable(survivors, func(i, j int) bool {
+				return survivors[i].After < survivors[j].After
+			})
+			survivors[0].After++
+			sim.AdapterFailovers = append(sim.AdapterFailovers, &Failover{StreamID: s.ID, From: a.IP, To: survivors[0].IP})
+		}
+	}
+	return sim
+}
+
+// simulate runs a simulation for the hosts named by r's host parameters.
+func (s *server) simulate(r *http.Request) (*Simulation, error) {
+	hd, err := s.fetch(r, partCatchers, partAdapters)
+	if err != nil {
+		return nil, err
+	}
+	failed := make(hostSet)
+	for _, h := range r.URL.Query()["host"] {
+		if h != "" {
+			failed[h] = true
+		}
+	}
+	sim := simulateFailure(hd.Catchers, hd.Adapters, failed, s.limits(r.Context()))
+	sim.Degraded = hd.Degraded
+	return sim, nil
+}
+
+func (s *server) Simulate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	sim, err := s.simulate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = templates.ExecuteTemplate(w, "simulate.html", sim)
+	if err != nil {
+		log.Error("error executing template %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *server) SimulateJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	sim, err := s.simulate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveJson(w, sim)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func simulateJSON(t *testing.T, s *server, query string) *Simulation {
+	w := get(s, "/api/simulate?"+query)
+	assert.Equal(t, http.StatusOK, w.Code)
+	sim := &Simulation{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), sim))
+	return sim
+}
+
+func TestSimulateCatcherFailure(t *testing.T) {
+	s := testServer(t)
+	s.hostCapacity = map[string]int{"catcher02": 4}
+
+	sim := simulateJSON(t, s, "host=catcher01")
+	assert.Len(t, sim.CatcherFailovers, 3)
+	for _, f := range sim.CatcherFailovers {
+		assert.Equal(t, "catcher02.syncbak.corp", f.To)
+	}
+	assert.Empty(t, sim.Dark)
+	assert.Equal(t, []string{"KEEE-1005", "KFFF-1006"}, sim.Unprotected)
+	if over := sim.Overloaded(); assert.Len(t, over, 1) {
+		assert.Equal(t, "10.10.1.12", over[0].IP)
+		assert.Equal(t, 5, over[0].After)
+	}
+
+	sim = simulateJSON(t, s, "host=10.10.1.21&host=catcher01.syncbak.corp&host=catcher02")
+	assert.Empty(t, sim.CatcherFailovers)
+	assert.Len(t, sim.Dark, 7)
+	assert.Equal(t, []string{"10.10.1.21", "catcher01.syncbak.corp", "catcher02"}, sim.Failed)
+}
+
+func TestSimulateAdapterFailure(t *testing.T) {
+	s := testServer(t)
+
+	sim := simulateJSON(t, s, "host=10.10.2.11")
+	assert.Len(t, sim.AdapterFailovers, 3)
+	assert.Empty(t, sim.Overloaded())
+
+	sim = simulateJSON(t, s, "host=10.10.2.11&host=10.10.2.12")
+	assert.Len(t, sim.Dark, 6)
+	assert.Equal(t, "no adapter left", sim.Dark[0].Reason)
+}
+
+func TestSimulatePage(t *testing.T) {
+	s := testServer(t)
+	w := get(s, "/simulate")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `value="10.10.1.21"`)
+
+	body := get(s, "/simulate?host=10.10.1.21").Body.String()
+	assert.Contains(t, body, `value="10.10.1.21" checked`)
+	assert.Contains(t, body, "WGGG-1007")
+}
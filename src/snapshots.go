@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Syncbak-Git/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// placementRef is where a catcher stream is at the time of a snapshot.
+type placementRef struct {
+	Host       string `json:"host"`
+	ActiveHost string `json:"activeHost,omitempty"`
+}
+
+// snapshot is the point in time state events and diffs are derived from. Maps are nil for parts whose
+// data was unavailable when the snapshot was taken.
+type snapshot struct {
+	Time time.Time `json:"time"`
+	// Catchers, Adapters and Transcoders map stream id to where the stream is at that stage.
+	Catchers    map[string]*placementRef `json:"catchers"`
+	Adapters    map[string]string        `json:"adapters"`
+	Transcoders map[string]string        `json:"transcoders"`
+	// CatcherHosts and AdapterHosts map each host to its capacity. Transcoders have no configured
+	// capacity so TranscoderHosts only records which were seen, with zero.
+	CatcherHosts    map[string]int `json:"catcherHosts"`
+	AdapterHosts    map[string]int `json:"adapterHosts"`
+	TranscoderHosts map[string]int `json:"transcoderHosts"`
+	// Redirects maps each redirect host to its Max.
+	Redirects map[string]int `json:"redirects"`
+}
+
+// catcherName is how a catcher appears in events: its short host name, or ip without one.
+func catcherName(c *Catcher) string {
+	if c.Hostname == "" {
+		return c.IP
+	}
+	return shortHost(c.Hostname)
+}
+
+func snapshotOf(hd *HomeDisplay, limits *capacityLimits, now time.Time) *snapshot {
+	missing := make(map[string]bool)
+	for _, d := range hd.Degraded {
+		missing[d.Source] = true
+	}
+	snap := &snapshot{Time: now}
+	if !missing[partNames[partCatchers]] {
+		snap.Catchers = make(map[string]*placementRef)
+		snap.CatcherHosts = make(map[string]int)
+		for _, c := range hd.Catchers {
+			snap.CatcherHosts[catcherName(c)] = limits.catcherCapacity(c)
+			for _, s := range c.Streams {
+				ref := &placementRef{Host: catcherName(c)}
+				if s.ActiveHost != "" {
+					ref.ActiveHost = shortHost(s.ActiveHost)
+				}
+				snap.Catchers[s.ID] = ref
+			}
+		}
+	}
+	if !missing[partNames[partAdapters]] {
+		snap.Adapters = make(map[string]string)
+		snap.AdapterHosts = make(map[string]int)
+		for _, a := range hd.Adapters {
+			snap.AdapterHosts[a.IP] = limits.adapterCapacity(a)
+			for _, s := range a.Streams {
+				snap.Adapters[s.ID] = a.IP
+			}
+		}
+	}
+	if !missing[partNames[partTranscoders]] {
+		snap.Transcoders = make(map[string]string)
+		snap.TranscoderHosts = make(map[string]int)
+		for _, t := range hd.Transcoders {
+			snap.TranscoderHosts[shortHost(t.Host)] = 0
+			for _, s := range t.Streams {
+				snap.Transcoders[s.ID] = shortHost(t.Host)
+			}
+		}
+	}
+	if !missing[partNames[partRedirects]] {
+		snap.Redirects = make(map[string]int)
+		for _, r := range hd.Redirects {
+			snap.Redirects[r.Host] = r.Max
+		}
+	}
+	return snap
+}
+
+// carryOver fills the parts missing from snap with prev's so an outage is not read as every stream
+// being unassigned.
+func (snap *snapshot) carryOver(prev *snapshot) {
+	if snap.Catchers == nil {
+		snap.Catchers, snap.CatcherHosts = prev.Catchers, prev.CatcherHosts
+	}
+	if snap.Adapters == nil {
+		snap.Adapters, snap.AdapterHosts = prev.Adapters, prev.AdapterHosts
+	}
+	if snap.Transcoders == nil {
+		snap.Transcoders, snap.TranscoderHosts = prev.Transcoders, prev.TranscoderHosts
+	}
+	if snap.Redirects == nil {
+		snap.Redirects = prev.Redirects
+	}
+}
+
+// sameState reports whether snap and other differ only in when they were taken.
+func (snap *snapshot) sameState(other *snapshot) bool {
+	a, b := *snap, *other
+	a.Time, b.Time = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+// diffStreams adds an event for every stream that was assigned, moved or unassigned at stage.
+func diffStreams(add func(*Event), stage string, prev, cur map[string]string) {
+	if prev == nil || cur == nil {
+		return
+	}
+	for id, was := range prev {
+		if _, ok := cur[id]; !ok {
+			add(&Event{Stage: stage, Kind: eventUnassigned, StreamID: id, From: was})
+		}
+	}
+	for id, is := range cur {
+		was, ok := prev[id]
+		switch {
+		case !ok:
+			add(&Event{Stage: stage, Kind: eventAssigned, StreamID: id, To: is})
+		case was != is:
+			add(&Event{Stage: stage, Kind: eventMoved, StreamID: id, From: was, To: is})
+		}
+	}
+}
+
+// diffSnapshots returns the events that take prev to cur, ordered by stage and stream. Parts missing
+// from either snapshot produce no events.
+func diffSnapshots(prev, cur *snapshot) []*Event {
+	var events []*Event
+	add := func(e *Event) {
+		e.Time = cur.Time
+		events = append(events, e)
+	}
+	if prev.Catchers != nil && cur.Catchers != nil {
+		hosts := func(refs map[string]*placementRef) map[string]string {
+			m := make(map[string]string)
+			for id, ref := range refs {
+				m[id] = ref.Host
+			}
+			return m
+		}
+		diffStreams(add, partNames[partCatchers], hosts(prev.Catchers), hosts(cur.Catchers))
+		for id, is := range cur.Catchers {
+			if was, ok := prev.Catchers[id]; ok && was.Host == is.Host && was.ActiveHost != is.ActiveHost {
+				add(&Event{Stage: partNames[partCatchers], Kind: eventActiveFlipped, StreamID: id, Host: is.Host,
+					From: was.ActiveHost, To: is.ActiveHost})
+			}
+		}
+	}
+	diffStreams(add, partNames[partAdapters], prev.Adapters, cur.Adapters)
+	diffStreams(add, partNames[partTranscoders], prev.Transcoders, cur.Transcoders)
+	if prev.Redirects != nil && cur.Redirects != nil {
+		for host := range prev.Redirects {
+			if _, ok := cur.Redirects[host]; !ok {
+				add(&Event{Stage: partNames[partRedirects], Kind: eventRedirectVanished, Host: host})
+			}
+		}
+		for host := range cur.Redirects {
+			if _, ok := prev.Redirects[host]; !ok {
+				add(&Event{Stage: partNames[partRedirects], Kind: eventRedirectAppeared, Host: host})
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if a.Stage != b.Stage {
+			return a.Stage < b.Stage
+		}
+		if a.StreamID != b.StreamID {
+			return a.StreamID < b.StreamID
+		}
+		return a.Host < b.Host
+	})
+	return events
+}
+
+// snapshotStore is an append only file of snapshots, one json object per line, in the order taken.
+type snapshotStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newSnapshotStore(path string) *snapshotStore {
+	return &snapshotStore{path: path}
+}
+
+func (st *snapshotStore) append(snap *snapshot) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f, err := os.OpenFile(st.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(snap); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// at returns the last snapshot taken at or before t, or nil if there is none.
+func (st *snapshotStore) at(t time.Time) (*snapshot, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f, err := os.Open(st.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var found *snapshot
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		snap := &snapshot{}
+		if err := json.Unmarshal(scanner.Bytes(), snap); err != nil {
+			log.Error("skipping bad snapshot in %s: %s", st.path, err)
+			continue
+		}
+		if snap.Time.After(t) {
+			break
+		}
+		found = snap
+	}
+	return found, scanner.Err()
+}
+
+// HostChange is a host that appeared or disappeared at a stage.
+type HostChange struct {
+	Stage string `json:"stage"`
+	Host  string `json:"host"`
+}
+
+// CountChange is a host whose capacity, workers or redirect Max changed.
+type CountChange struct {
+	Stage  string `json:"stage"`
+	Host   string `json:"host"`
+	Before int    `json:"before"`
+	After  int    `json:"after"`
+}
+
+// SnapshotDiff is what changed between the snapshots in effect at two times.
+type SnapshotDiff struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// FromSnapshot and ToSnapshot are when the compared snapshots were taken.
+	FromSnapshot time.Time      `json:"fromSnapshot"`
+	ToSnapshot   time.Time      `json:"toSnapshot"`
+	HostsAdded   []*HostChange  `json:"hostsAdded"`
+	HostsRemoved []*HostChange  `json:"hostsRemoved"`
+	Streams      []*Event       `json:"streams"`
+	Capacity     []*CountChange `json:"capacity"`
+	RedirectMax  []*CountChange `json:"redirectMax"`
+}
+
+// diffHosts adds the hosts added, removed and changed in count between prev and cur at stage.
+func (d *SnapshotDiff) diffHosts(stage string, prev, cur map[string]int, changes *[]*CountChange) {
+	if prev == nil || cur == nil {
+		return
+	}
+	for host := range prev {
+		if _, ok := cur[host]; !ok {
+			d.HostsRemoved = append(d.HostsRemoved, &HostChange{Stage: stage, Host: host})
+		}
+	}
+	for host, n := range cur {
+		was, ok := prev[host]
+		switch {
+		case !ok:
+			d.HostsAdded = append(d.HostsAdded, &HostChange{Stage: stage, Host: host})
+		case was != n:
+			*changes = append(*changes, &CountChange{Stage: stage, Host: host, Before: was, After: n})
+		}
+	}
+}
+
+func diffBetween(prev, cur *snapshot) *SnapshotDiff {
+	d := &SnapshotDiff{FromSnapshot: prev.Time, ToSnapshot: cur.Time, HostsAdded: []*HostChange{}, HostsRemoved: []*HostChange{},
+		Streams: []*Event{}, Capacity: []*CountChange{}, RedirectMax: []*CountChange{}}
+	d.diffHosts(partNames[partCatchers], prev.CatcherHosts, cur.CatcherHosts, &d.Capacity)
+	d.diffHosts(partNames[partAdapters], prev.AdapterHosts, cur.AdapterHosts, &d.Capacity)
+	d.diffHosts(partNames[partTranscoders], prev.TranscoderHosts, cur.TranscoderHosts, &d.Capacity)
+	d.diffHosts(partNames[partRedirects], prev.Redirects, cur.Redirects, &d.RedirectMax)
+	for _, e := range diffSnapshots(prev, cur) {
+		if e.Stage != partNames[partRedirects] {
+			d.Streams = append(d.Streams, e)
+		}
+	}
+	for _, hs := range [][]*HostChange{d.HostsAdded, d.HostsRemoved} {
+		sort.Slice(hs, func(i, j int) bool {
+			if hs[i].Stage != hs[j].Stage {
+				return hs[i].Stage < hs[j].Stage
+			}
+			return hs[i].Host < hs[j].Host
+		})
+	}
+	for _, cs := range [][]*CountChange{d.Capacity, d.RedirectMax} {
+		sort.Slice(cs, func(i, j int) bool {
+			if cs[i].Stage != cs[j].Stage {
+				return cs[i].Stage < cs[j].Stage
+			}
+			return cs[i].Host < cs[j].Host
+		})
+	}
+	return d
+}
+
+// DiffDisplay is the snapshot diff page. Diff is nil until both times are chosen.
+type DiffDisplay struct {
+	From  string
+	To    string
+	Diff  *SnapshotDiff
+	Error string
+}
+
+// snapshotDiff compares the snapshots in effect at r's from and to times, to defaulting to now. It
+// returns an error message and status when it cannot.
+func (s *server) snapshotDiff(r *http.Request) (*SnapshotDiff, int, string) {
+	if s.tracker == nil || s.tracker.snapshots == nil {
+		return nil, http.StatusNotFound, "no snapshot log configured"
+	}
+	q := r.URL.Query()
+	if q.Get("from") == "" {
+		return nil, http.StatusBadRequest, "from is required"
+	}
+	from, err := parseWindowTime(q.Get("from"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err.Error()
+	}
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		if to, err = parseWindowTime(v); err != nil {
+			return nil, http.StatusBadRequest, err.Error()
+		}
+	}
+	if !from.Before(to) {
+		return nil, http.StatusBadRequest, "from must be before to"
+	}
+	prev, err := s.tracker.snapshots.at(from)
+	if err == nil && prev == nil {
+		return nil, http.StatusNotFound, "no snapshot at or before " + from.Format(time.RFC3339)
+	}
+	var cur *snapshot
+	if err == nil {
+		cur, err = s.tracker.snapshots.at(to)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err.Error()
+	}
+	d := diffBetween(prev, cur)
+	d.From, d.To = from, to
+	return d, http.StatusOK, ""
+}
+
+func (s *server) SnapshotDiff(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	dd := &DiffDisplay{From: q.Get("from"), To: q.Get("to")}
+	if dd.From != "" {
+		var status int
+		dd.Diff, status, dd.Error = s.snapshotDiff(r)
+		if dd.Diff == nil {
+			w.WriteHeader(status)
+		}
+	}
+	err := templates.ExecuteTemplate(w, "diff.html", dd)
+	if err != nil {
+		log.Error("error executing template %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *server) SnapshotDiffJSON(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	d, status, msg := s.snapshotDiff(r)
+	if d == nil {
+		http.Error(w, msg, status)
+		return
+	}
+	serveJson(w, d)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	l, cleanup := tempEventLog(t)
+	defer cleanup()
+	st := newSnapshotStore(filepath.Join(filepath.Dir(l.path), "snapshots.jsonl"))
+	s := testServer(t)
+	s.tracker = newTracker(l, st)
+	f := s.catchers.(*fixture)
+
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	observe := func(at time.Time) []*Event {
+		hd, err := s.fetch(httptest.NewRequest("GET", "/", nil), partCatchers, partAdapters, partTranscoders, partRedirects)
+		assert.Nil(t, err)
+		events, err := s.tracker.observe(hd, s.limits(context.Background()), at)
+		assert.Nil(t, err, "%s", err)
+		return events
+	}
+	observe(t0)
+	observe(t0.Add(time.Minute))
+
+	moved := f.CatcherList[2].Streams[1]
+	f.CatcherList[2].Streams = f.CatcherList[2].Streams[:1]
+	f.CatcherList[1].Streams = append(f.CatcherList[1].Streams, moved)
+	f.RedirectList[0].Max = 2000
+	f.AdapterList = f.AdapterList[:1]
+	s.hostCapacity = map[string]int{"catcher02": 12}
+	t2 := t0.Add(2 * time.Minute)
+	observe(t2)
+
+	b, err := ioutil.ReadFile(st.path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, strings.Count(string(b), "\n"), "unchanged snapshots are not stored")
+
+	// A restarted tracker resumes from the stored snapshot.
+	s.tracker = newTracker(l, st)
+	f.CatcherList[1].Streams = f.CatcherList[1].Streams[:len(f.CatcherList[1].Streams)-1]
+	if events := observe(t2.Add(time.Minute)); assert.Len(t, events, 1) {
+		assert.Equal(t, eventUnassigned, events[0].Kind)
+	}
+
+	var d SnapshotDiff
+	w := get(s, "/api/snapshots/diff?from="+t0.Add(30*time.Second).Format(time.RFC3339)+"&to="+t0.Add(90*time.Second).Format(time.RFC3339))
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &d))
+	assert.Empty(t, d.Streams, "nothing changed between the first two observations")
+
+	w = get(s, "/api/snapshots/diff?from="+t0.Add(30*time.Second).Format(time.RFC3339)+"&to="+t2.Format(time.RFC3339))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	d = SnapshotDiff{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &d))
+	assert.True(t, d.FromSnapshot.Equal(t0))
+	assert.True(t, d.ToSnapshot.Equal(t2))
+	assert.Equal(t, []*HostChange{{Stage: "adapter", Host: "10.10.2.12"}}, d.HostsRemoved)
+	assert.Empty(t, d.HostsAdded)
+	assert.Equal(t, []*CountChange{{Stage: "catcher", Host: "catcher02", Before: 9, After: 12}}, d.Capacity)
+	assert.Equal(t, []*CountChange{{Stage: "redirect", Host: "redirect01.syncbak.corp", Before: 1500, After: 2000}}, d.RedirectMax)
+	var moves []string
+	for _, e := range d.Streams {
+		if e.Kind == eventMoved {
+			moves = append(moves, e.Stage+" "+e.StreamID+" "+e.From+" "+e.To)
+		}
+	}
+	assert.Equal(t, []string{"catcher WGGG-1007 catcher03 catcher02"}, moves)
+
+	w = get(s, "/snapshots/diff?from="+t0.Add(30*time.Second).Format(time.RFC3339))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "WGGG-1007")
+
+	assert.Equal(t, http.StatusBadRequest, get(s, "/api/snapshots/diff").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/api/snapshots/diff?from="+t0.Add(-time.Hour).Format(time.RFC3339)).Code)
+}
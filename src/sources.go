@@ -0,0 +1,51 @@
+package main
+
+import "context"
+
+// CatcherSource provides catcher assignments from the nameservice.
+type CatcherSource interface {
+	Catchers(ctx context.Context) ([]*Catcher, error)
+}
+
+// AdapterSource provides the streams each CDN adapter handled during a window.
+type AdapterSource interface {
+	Adapters(ctx context.Context, w window) ([]*Adapter, error)
+}
+
+// TranscoderSource provides transcoder hosts and their load.
+type TranscoderSource interface {
+	Transcoders(ctx context.Context, w window) ([]*Transcoder, error)
+	ActiveStreamCount(ctx context.Context, w window) (int, error)
+	WorkersInUse(ctx context.Context, w window) (float64, error)
+}
+
+// RedirectSource provides the redirect hosts that last reported during a window.
+type RedirectSource interface {
+	Redirects(ctx context.Context, w window) ([]*RedirectHost, error)
+}
+
+// esAdapters infers adapter assignments from cdnadapter logs in elasticsearch.
+type esAdapters struct {
+	cluster string
+}
+
+func (s *esAdapters) Adapters(ctx context.Context, w window) ([]*Adapter, error) {
+	return adapterAssignments(ctx, s.cluster, w)
+}
+
+// esTranscoders reads transcoder activity from Phase6Transcoder logs in elasticsearch.
+type esTranscoders struct {
+	cluster string
+}
+
+func (s *esTranscoders) Transcoders(ctx context.Context, w window) ([]*Transcoder, error) {
+	return connectedTranscoders(ctx, s.cluster, w)
+}
+
+func (s *esTranscoders) ActiveStreamCount(ctx context.Context, w window) (int, error) {
+	return ActiveSourceStreamCount(ctx, w)
+}
+
+func (s *esTranscoders) WorkersInUse(ctx context.Context, w window) (float64, error) {
+	return transcoderWorkersInUse(ctx, w)
+}
@@ -1,50 +1,100 @@
 package main
 
 import (
-	"time"
+	"context"
+	"sort"
+	"strings"
 
 	"github.com/Syncbak-Git/elasticgo"
 )
 
-func ActiveSourceStreamCount() (int, error) {
-	client, err := elasticgo.NewClient()
-	check(err)
+// maxTranscoderErrors is the most error entries kept per transcoder, newest first.
+const maxTranscoderErrors = 20
 
-	start := time.Now().Add(-4 * time.Minute).UTC()
-	end := time.Now().UTC()
+// The elasticgo calls below take no context. Each runs under within so the caller returns as soon as
+// ctx ends, leaving the abandoned request to finish in the background.
 
-	sourceStreamCount, err := client.SourceStreamCountAtTranscode(start, end)
-	check(err)
+func ActiveSourceStreamCount(ctx context.Context, w window) (int, error) {
+	var sourceStreamCount int64
+	err := within(ctx, 0, func(ctx context.Context) error {
+		client, err := elasticgo.NewClient()
+		if err != nil {
+			return err
+		}
+
+		sourceStreamCount, err = client.SourceStreamCountAtTranscode(w.From.UTC(), w.To.UTC())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
 
 	return int(sourceStreamCount), nil
 }
 
-func connectedTranscoders() (map[string][]string, error) {
-	client, err := elasticgo.NewClientForCluster("qa")
-	check(err)
-
-	start := time.Now().Add(-4 * time.Minute).UTC()
-	end := time.Now().UTC()
-	transcoderClient, err := client.NewSearchClientBuilder().SearchRange(start, end).Filter("fields.name:Phase6Transcoder").Build()
-	check(err)
+func connectedTranscoders(ctx context.Context, cluster string, w window) ([]*Transcoder, error) {
+	entries, err := findAll(ctx, finderFor(cluster, "Phase6Transcoder"), w.From, w.To)
+	if err != nil {
+		return nil, err
+	}
+	return transcodersFromEntries(entries), nil
+}
 
-	entries, err := transcoderClient.Entries()
-	check(err)
+// transcodersFromEntries builds the stream inventory of every transcoder host that logged. A host's
+// workers are the distinct worker threads among its entries, so a stream transcoded by several
+// threads counts once per thread.
+func transcodersFromEntries(entries []elasticgo.Entry) []*Transcoder {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Timestamp.After(entries[j].Timestamp)
+	})
 
-	checkerMap := make(map[string][]string)
+	hosts := make(map[string]*Transcoder)
+	streams := make(map[string]map[string]*SourceStream)
+	threads := make(map[string]map[string]bool)
 	for _, entry := range entries {
-		serverName := entry.Fields.Host
-		if _, found := checkerMap[serverName]; !found {
-			checkerMap[serverName] = []string{"Various"}
+		t, found := hosts[entry.Fields.Host]
+		if !found {
+			t = &Transcoder{Host: entry.Fields.Host, LastSeen: entry.Timestamp, Streams: []*SourceStream{}, Errors: []*TranscoderError{}}
+			hosts[entry.Fields.Host] = t
+			streams[entry.Fields.Host] = make(map[string]*SourceStream)
+			threads[entry.Fields.Host] = make(map[string]bool)
+		}
+		if thread := entry.Fields.Thread; thread != "" {
+			threads[t.Host][thread] = true
+		}
+		if id := entry.Fields.SourceStreamID; id != "" {
+			if _, ok := streams[t.Host][id]; !ok {
+				s := &SourceStream{ID: id, LastSeen: entry.Timestamp}
+				streams[t.Host][id] = s
+				t.Streams = append(t.Streams, s)
+			}
+		}
+		if strings.EqualFold(entry.Fields.Level, "error") && len(t.Errors) < maxTranscoderErrors {
+			t.Errors = append(t.Errors, &TranscoderError{Time: entry.Timestamp, StreamID: entry.Fields.SourceStreamID, Message: entry.Fields.Message})
 		}
 	}
-	return checkerMap, nil
+
+	transcoders := make([]*Transcoder, 0, len(hosts))
+	for _, t := range hosts {
+		sortStreams(t.Streams)
+		t.Workers = len(threads[t.Host])
+		transcoders = append(transcoders, t)
+	}
+	sort.Slice(transcoders, func(i, j int) bool {
+		return transcoders[i].Host < transcoders[j].Host
+	})
+	return transcoders
 }
 
-func transcoderWorkersInUse() (float64, error) {
-	client, err := elasticgo.NewClient()
-	check(err)
-	start := time.Now().Add(-4 * time.Minute).UTC()
-	end := time.Now().UTC()
-	return client.TranscoderInProgressThreads(start, end)
+func transcoderWorkersInUse(ctx context.Context, w window) (float64, error) {
+	var workers float64
+	err := within(ctx, 0, func(ctx context.Context) error {
+		client, err := elasticgo.NewClient()
+		if err != nil {
+			return err
+		}
+		workers, err = client.TranscoderInProgressThreads(w.From.UTC(), w.To.UTC())
+		return err
+	})
+	return workers, err
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Syncbak-Git/elasticgo"
+	"github.com/stretchr/testify/assert"
+)
+
+func transcoderEntry(host, ssid, level string, at time.Time) elasticgo.Entry {
+	e := elasticgo.Entry{Timestamp: at}
+	e.Fields.Host = host
+	e.Fields.SourceStreamID = ssid
+	e.Fields.Level = level
+	e.Fields.Message = "transcode " + ssid
+	e.Fields.Thread = "worker-" + ssid
+	return e
+}
+
+func TestTranscodersFromEntries(t *testing.T) {
+	now := time.Now()
+	entries := []elasticgo.Entry{
+		transcoderEntry("tc01", "KAAA-1001", "INFO", now.Add(-3*time.Minute)),
+		transcoderEntry("tc01", "KAAA-1001", "INFO", now.Add(-time.Minute)),
+		transcoderEntry("tc01", "KBBB-1002", "ERROR", now.Add(-2*time.Minute)),
+		transcoderEntry("tc02", "", "INFO", now),
+	}
+	second := transcoderEntry("tc01", "KAAA-1001", "INFO", now.Add(-2*time.Minute))
+	second.Fields.Thread = "worker-2"
+	transcoders := transcodersFromEntries(append(entries, second))
+	assert.Len(t, transcoders, 2)
+
+	tc01 := transcoders[0]
+	assert.Equal(t, "tc01", tc01.Host)
+	assert.Equal(t, now.Add(-time.Minute), tc01.LastSeen)
+	assert.Len(t, tc01.Streams, 2)
+	assert.Equal(t, 3, tc01.Workers, "KAAA-1001 is on two threads")
+	assert.Equal(t, "KBBB-1002", tc01.Streams[1].ID)
+	assert.Len(t, tc01.Errors, 1)
+	assert.Equal(t, "KBBB-1002", tc01.Errors[0].StreamID)
+
+	assert.Empty(t, transcoders[1].Streams)
+	assert.Equal(t, 1, transcoders[1].Workers)
+	assert.Empty(t, transcoders[1].Errors)
+}
+
+func TestTranscodersJSON(t *testing.T) {
+	var transcoders []*Transcoder
+	assert.Nil(t, json.Unmarshal(get(testServer(t), "/api/transcoders").Body.Bytes(), &transcoders))
+	if assert.Len(t, transcoders, 2) {
+		assert.Equal(t, 3, transcoders[0].Workers)
+	}
+}
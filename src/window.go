@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// window is the time range a log derived view looks at.
+type window struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+func lastWindow(d time.Duration, now time.Time) window {
+	return window{From: now.Add(-d), To: now}
+}
+
+func (w window) contains(t time.Time) bool {
+	return !t.Before(w.From) && !t.After(w.To)
+}
+
+// pickerLayout is the format sent by an html datetime-local input. It carries no zone so it is read
+// in the server's local time.
+const pickerLayout = "2006-01-02T15:04"
+
+// requestWindow returns the window asked for by the since (a duration such as 15m) or from and to
+// (RFC3339 or datetime-local) query parameters, or the last def when neither is given.
+func requestWindow(r *http.Request, def time.Duration, now time.Time) (window, error) {
+	q := r.URL.Query()
+	if since := q.Get("since"); since != "" {
+		d, err := time.ParseDuration(since)
+		if err != nil || d <= 0 {
+			return window{}, fmt.Errorf("since must be a positive duration such as 15m, got %q", since)
+		}
+		return lastWindow(d, now), nil
+	}
+	from, to := q.Get("from"), q.Get("to")
+	if from == "" && to == "" {
+		return lastWindow(def, now), nil
+	}
+	w := window{To: now}
+	var err error
+	if from == "" {
+		return window{}, fmt.Errorf("to requires from")
+	}
+	if w.From, err = parseWindowTime(from); err != nil {
+		return window{}, err
+	}
+	if to != "" {
+		if w.To, err = parseWindowTime(to); err != nil {
+			return window{}, err
+		}
+	}
+	if !w.From.Before(w.To) {
+		return window{}, fmt.Errorf("from %s is not before to %s", from, to)
+	}
+	return w, nil
+}
+
+func parseWindowTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(pickerLayout, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse time %q, use RFC3339 or %s", s, pickerLayout)
+	}
+	return t, nil
+}
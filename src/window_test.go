@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestWindow(t *testing.T) {
+	now := time.Date(2019, 11, 22, 16, 0, 0, 0, time.UTC)
+	cases := map[string]window{
+		"/":                           {now.Add(-4 * time.Minute), now},
+		"/?since=1h":                  {now.Add(-time.Hour), now},
+		"/?from=2019-11-22T14:00:00Z": {now.Add(-2 * time.Hour), now},
+		"/?from=2019-11-22T14:00:00Z&to=2019-11-22T15:00:00Z": {now.Add(-2 * time.Hour), now.Add(-time.Hour)},
+	}
+	for path, want := range cases {
+		w, err := requestWindow(httptest.NewRequest("GET", path, nil), 4*time.Minute, now)
+		assert.Nil(t, err, "%s %s", path, err)
+		assert.True(t, want.From.Equal(w.From) && want.To.Equal(w.To), "%s got %+v", path, w)
+	}
+
+	for _, path := range []string{"/?since=-5m", "/?since=soon", "/?to=2019-11-22T15:00:00Z", "/?from=2019-11-22T16:30:00Z&to=2019-11-22T15:00:00Z", "/?from=yesterday"} {
+		_, err := requestWindow(httptest.NewRequest("GET", path, nil), 4*time.Minute, now)
+		assert.NotNil(t, err, path)
+	}
+}